@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 	"errors"
 	"strings"
@@ -16,11 +20,62 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
+
+	"AuthenticationService/errcode"
 )
 
 var jwtKey = []byte("supersecretkey") // Use env variable in production
 var userServiceURL = getEnv("USER_SERVICE_URL", "http://user-service:8081")
-var serviceSecret = getEnv("SERVICE_SECRET", "service-secret-key")
+// serviceSecret is the shared key for service-to-service calls. The default
+// matches the user service's so a fresh checkout can create profiles, but it
+// is public, so this service won't accept it on its own internal routes.
+const defaultServiceSecret = "service-secret-key"
+
+var serviceSecret = getEnv("SERVICE_SECRET", defaultServiceSecret)
+
+// serviceAuthConfigured reports whether SERVICE_SECRET was set to something
+// other than the well-known default.
+func serviceAuthConfigured() bool {
+	return serviceSecret != "" && serviceSecret != defaultServiceSecret
+}
+
+// envPrefix lets several environments share one Mongo instance by giving each
+// its own set of collections, e.g. ENV_PREFIX=staging uses staging_users.
+var envPrefix = getEnv("ENV_PREFIX", "")
+
+// now is the service's clock. Everything time-dependent (token issue and
+// expiry, session expiry, rate-limit windows) reads it instead of calling
+// time.Now directly, so tests can swap in a fixed clock.
+var now = time.Now
+
+// background tracks fire-and-forget work started by handlers (profile
+// creation, login audit) so shutdown can wait for it before disconnecting
+// from Mongo.
+var background sync.WaitGroup
+
+func runInBackground(fn func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// waitUntil waits for wg until ctx is done, reporting whether everything
+// finished. Shutdown uses it so stuck background work can't hold the process.
+func waitUntil(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -30,34 +85,67 @@ func getEnv(key, defaultValue string) string {
 }
 
 type User struct {
-	Username string `bson:"username"`
-	Password string `bson:"password"`
-	Name     string `bson:"name"`
+	Username   string `bson:"username"`
+	Password   string `bson:"password"`
+	Name       string `bson:"name"`
+	Email      string `bson:"email,omitempty"`
+	Role       string `bson:"role,omitempty"`
+	TokenEpoch int64  `bson:"token_epoch"`
+
+	// EmailVerified is set only when a trusted party vouched for Email (so
+	// far, Google at sign-in); registration takes the address on trust.
+	// GoogleSub is the Google account linked to this user, if any.
+	EmailVerified bool   `bson:"email_verified,omitempty"`
+	GoogleSub     string `bson:"google_sub,omitempty"`
+
+	// PasswordHistory holds the bcrypt hashes of previous passwords, newest
+	// first, capped at PASSWORD_HISTORY-1 entries.
+	PasswordHistory []string `bson:"password_history,omitempty"`
 }
 
 type Credentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Name     string `json:"name,omitempty"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+	Remember bool   `json:"remember,omitempty"`
+}
+
+// Registration is the register request. Username and password are always
+// required; whether name and email are is decided by REGISTER_REQUIRED_FIELDS
+// (see validateRequiredFields), so the tags only cover their format.
+type Registration struct {
+	Username string `json:"username" validate:"required,username"`
+	Password string `json:"password" validate:"required,min=6,max=72"`
+	Name     string `json:"name" validate:"max=100"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
 }
 
 type Claims struct {
 	Username string `json:"username"`
+	Scope    string `json:"scope,omitempty"`
+	Epoch    int64  `json:"epoch"`
 	jwt.RegisteredClaims
 }
 
 var client *mongo.Client
 var userCollection *mongo.Collection
 
+// Errors returned by validateJWTFromRequest. Expired tokens are reported
+// separately so clients know to refresh rather than send the user back to
+// the login screen.
+var (
+	errTokenExpired = errors.New("token expired")
+	errTokenInvalid = errors.New("invalid token")
+)
+
 func getBearerToken(r *http.Request) (string, error) {
     authHeader := r.Header.Get("Authorization")
     if authHeader == "" {
-        return "", errors.New("missing Authorization header")
+        return "", fmt.Errorf("%w: missing Authorization header", errTokenInvalid)
     }
 
     parts := strings.SplitN(authHeader, " ", 2)
     if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
-        return "", errors.New("invalid Authorization header format")
+        return "", fmt.Errorf("%w: invalid Authorization header format", errTokenInvalid)
     }
 
     return strings.TrimSpace(parts[1]), nil
@@ -69,6 +157,19 @@ func validateJWTFromRequest(r *http.Request) (*Claims, error) {
         return nil, err
     }
 
+    if claims, ok := verifiedTokens.get(tokenString); ok {
+        return claims, nil
+    }
+    revision := verifiedTokens.revision()
+
+    parserOptions := []jwt.ParserOption{
+        jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+        jwt.WithTimeFunc(now),
+    }
+    if expectedAudience != "" {
+        parserOptions = append(parserOptions, jwt.WithAudience(expectedAudience))
+    }
+
     claims := &Claims{}
     token, err := jwt.ParseWithClaims(
         tokenString,
@@ -79,63 +180,237 @@ func validateJWTFromRequest(r *http.Request) (*Claims, error) {
             }
             return jwtKey, nil
         },
-        jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+        parserOptions...,
     )
+    if errors.Is(err, jwt.ErrTokenExpired) {
+        return nil, errTokenExpired
+    }
     if err != nil || !token.Valid {
-        return nil, errors.New("invalid or expired token")
+        return nil, errTokenInvalid
     }
 
+    // A token is only good while its session record exists, so revoked
+    // sessions are rejected even before the token itself expires.
+    if claims.ID == "" {
+        return nil, fmt.Errorf("%w: token has no session", errTokenInvalid)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), dbReadTimeout)
+    defer cancel()
+    active, err := sessionActive(ctx, claims.ID, claims.Username)
+    if err != nil || !active {
+        return nil, fmt.Errorf("%w: session revoked or expired", errTokenInvalid)
+    }
+    epoch, err := currentTokenEpoch(ctx, claims.Username)
+    if err != nil || claims.Epoch < epoch {
+        return nil, fmt.Errorf("%w: token predates the user's token epoch", errTokenInvalid)
+    }
+
+    verifiedTokens.put(tokenString, claims, revision)
     return claims, nil
 }
 
+// writeError is how every handler reports a failure: a JSON body with a
+// human-readable message and a stable code from the errcode package.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+		"code":  code,
+	})
+}
+
+// writeAuthError answers a request whose token failed validation: 403 when
+// the token is fine but not elevated, otherwise 401.
+func writeAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTokenScope) {
+		writeError(w, http.StatusForbidden, errcode.InsufficientScope, "Elevated token required")
+		return
+	}
+	if errors.Is(err, errTokenExpired) {
+		writeError(w, http.StatusUnauthorized, errcode.TokenExpired, "Token expired")
+		return
+	}
+	writeError(w, http.StatusUnauthorized, errcode.TokenInvalid, "Invalid token")
+}
+
+// Mongo operation timeouts. Point lookups should fail fast, writes get a
+// little longer, and scans over many documents (like the janitor's sweeps)
+// get much longer.
+var (
+	dbReadTimeout  = getEnvDuration("DB_READ_TIMEOUT", 3*time.Second)
+	dbWriteTimeout = getEnvDuration("DB_WRITE_TIMEOUT", 5*time.Second)
+	dbScanTimeout  = getEnvDuration("DB_SCAN_TIMEOUT", 30*time.Second)
+)
+
+func collectionName(name string) string {
+	if envPrefix == "" {
+		return name
+	}
+	return envPrefix + "_" + name
+}
+
+// mongoURI returns the connection string, preferring MONGO_URI_FILE (a
+// Docker/Kubernetes secret mount) so credentials needn't sit in the process
+// environment, then MONGO_URI.
+func mongoURI() (string, error) {
+	if path := getEnv("MONGO_URI_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading MONGO_URI_FILE: %w", err)
+		}
+		uri := strings.TrimSpace(string(data))
+		if uri == "" {
+			return "", errors.New("MONGO_URI_FILE is empty")
+		}
+		return uri, nil
+	}
+	return getEnv("MONGO_URI", "mongodb://mongodb:27017"), nil
+}
+
+// useDatabase points every collection handle at db.
+func useDatabase(db *mongo.Database) {
+	userCollection = db.Collection(collectionName("users"))
+	sessionCollection = db.Collection(collectionName("sessions"))
+	resetCollection = db.Collection(collectionName("password_resets"))
+	auditCollection = db.Collection(collectionName("login_audit"))
+}
+
+func ensureUserIndexes(ctx context.Context) error {
+	_, err := userCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "google_sub", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
+	})
+	return err
+}
+
+// ensureIndexes creates the indexes each collection relies on: uniqueness on
+// users and TTLs on everything that expires.
+func ensureIndexes(ctx context.Context) error {
+	for _, ensure := range []func(context.Context) error{
+		ensureUserIndexes,
+		ensureSessionIndexes,
+		ensureResetIndexes,
+		ensureAuditIndexes,
+	} {
+		if err := ensure(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func connectMongo() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	var err error
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI("mongodb://mongodb:27017"))
+	uri, err := mongoURI()
+	if err != nil {
+		log.Fatal("MongoDB config error: ", err)
+	}
+
+	client, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
 		log.Fatal("MongoDB connection error:", err)
 	}
 
-	userCollection = client.Database("authdb").Collection("users")
+	useDatabase(client.Database("authdb"))
+	if err := ensureIndexes(ctx); err != nil {
+		log.Fatal("MongoDB index error:", err)
+	}
 	log.Println("Connected to MongoDB")
 }
 
+const duplicateKeyCode = 11000
+
+// isDuplicateKey reports whether err is a unique-index violation. A count
+// before an insert can race another request, so inserts on index-backed fields
+// should turn this into a 409 rather than a 500.
+func isDuplicateKey(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
+
+// duplicateKeyOn reports whether err violates the unique index on field. It
+// reads the key pattern from the server's write error rather than matching
+// the index name in the message, which depends on how the index was made.
+func duplicateKeyOn(err error, field string) bool {
+	var reports []bson.Raw
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, we := range writeErr.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				reports = append(reports, we.Raw)
+			}
+		}
+	}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, we := range bulkErr.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				reports = append(reports, we.Raw)
+			}
+		}
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == duplicateKeyCode {
+		reports = append(reports, cmdErr.Raw)
+	}
+
+	for _, raw := range reports {
+		if _, err := raw.LookupErr("keyPattern", field); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func registerHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	if ok, retryAfter := registerLimiter.allow(clientIP(r)); !ok {
+		writeRateLimited(w, retryAfter)
 		return
 	}
 
-	var creds Credentials
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	var creds Registration
+	if !decodeJSONBody(w, r, &creds) {
 		return
 	}
+	// Emails are stored lowercased, matching what Google sign-in looks up.
+	creds.Email = strings.ToLower(strings.TrimSpace(creds.Email))
 
-	if creds.Username == "" || creds.Password == "" || creds.Name == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
+	errs := validateStruct(creds)
+	errs = append(errs, validateRequiredFields(creds)...)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
 	defer cancel()
 
 	// Check if username exists
 	count, err := userCollection.CountDocuments(ctx, bson.M{"username": creds.Username})
 	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
 		return
 	}
 	if count > 0 {
-		http.Error(w, "Username already exists", http.StatusConflict)
+		writeError(w, http.StatusConflict, errcode.UsernameTaken, "Username already exists")
 		return
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "Error processing password", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Error processing password")
 		return
 	}
 
@@ -143,26 +418,40 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		Username: creds.Username,
 		Password: string(hashedPassword),
 		Name:     creds.Name,
+		Email:    creds.Email,
 	}
 
 	_, err = userCollection.InsertOne(ctx, user)
+	if duplicateKeyOn(err, "email") {
+		writeError(w, http.StatusConflict, errcode.EmailTaken, "Email already registered")
+		return
+	}
+	if isDuplicateKey(err) {
+		writeError(w, http.StatusConflict, errcode.UsernameTaken, "Username already exists")
+		return
+	}
 	if err != nil {
-		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB insert error")
 		return
 	}
 
 	// Create user profile in user service (non-blocking)
-	go createUserProfile(creds.Username, creds.Name)
+	runInBackground(func() { createUserProfile(creds.Username, creds.Name, creds.Email) })
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("User registered successfully"))
 }
 
-func createUserProfile(username, name string) {
+func createUserProfile(username, name, email string) {
+	displayName := name
+	if displayName == "" {
+		displayName = username
+	}
+
 	profileData := map[string]interface{}{
 		"username":     username,
-		"display_name": name,
-		"email":        "",
+		"display_name": displayName,
+		"email":        email,
 		"timezone":     "UTC",
 		"country":      "",
 	}
@@ -198,38 +487,38 @@ func createUserProfile(username, name string) {
 	log.Printf("Successfully created user profile for %s", username)
 }
 
-// GET /authinfo/{username} (internal use only)
+// GET /authinfo/{username}
 func getUserInfo(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodGet {
-        http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
     claims, err := validateJWTFromRequest(r)
     if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        writeAuthError(w, err)
         return
     }
 
-    username := r.URL.Path[len("/authinfo/"):]
+    // The router matches this pattern on GET only, so a username that
+    // collides with another route (e.g. "update") still lands here and is
+    // treated as a plain username.
+    username := r.PathValue("username")
     if username == "" {
-        http.Error(w, "Username missing", http.StatusBadRequest)
+        writeError(w, http.StatusBadRequest, errcode.InvalidRequest, "Username missing")
         return
     }
 
-    // Prevent callers from fetching other users' info using a valid token.
+    // Callers may only read their own info. Any other username gets the same
+    // 404 as a username that doesn't exist, so a valid token can't be used to
+    // probe which accounts exist.
     if claims.Username != username {
-        http.Error(w, "Forbidden", http.StatusForbidden)
+        writeError(w, http.StatusNotFound, errcode.UserNotFound, "User not found")
         return
     }
 
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    ctx, cancel := context.WithTimeout(context.Background(), dbReadTimeout)
     defer cancel()
 
     var user User
     err = userCollection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
     if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
+        writeError(w, http.StatusNotFound, errcode.UserNotFound, "User not found")
         return
     }
 
@@ -242,93 +531,205 @@ func getUserInfo(w http.ResponseWriter, r *http.Request) {
 
 
 // PUT /authinfo/update
+//
+// Users may only rename themselves: the username comes from the token, and a
+// body username naming anyone else is refused.
 func updateUserInfo(w http.ResponseWriter, r *http.Request) {
+	claims, err := validateJWTFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
 	var payload struct {
 		Username string `json:"username"`
-		Name     string `json:"name"`
+		Name     string `json:"name" validate:"required,max=100"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if errs := validateStruct(payload); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if payload.Username != "" && payload.Username != claims.Username {
+		writeError(w, http.StatusForbidden, errcode.Forbidden, "Cannot update another user's info")
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	if err := setUserName(claims.Username, payload.Name); err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Failed to update user info")
+		return
+	}
 
-	filter := bson.M{"username": payload.Username}
-	update := bson.M{"$set": bson.M{"name": payload.Name}}
+	w.Write([]byte("Auth user name updated"))
+}
 
-	_, err := userCollection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		http.Error(w, "Failed to update user info", http.StatusInternalServerError)
+// PUT /internal/authinfo/update
+//
+// Service-to-service variant used by the account service's name sync. It is
+// wrapped in requireServiceAuth instead of taking a user token, so it may name
+// any user in the body.
+func updateUserInfoInternal(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Username string `json:"username" validate:"required"`
+		Name     string `json:"name" validate:"required,max=100"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if errs := validateStruct(payload); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := setUserName(payload.Username, payload.Name); err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Failed to update user info")
 		return
 	}
 
 	w.Write([]byte("Auth user name updated"))
 }
 
+func setUserName(username, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	_, err := userCollection.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"name": name}})
+	return err
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	var creds Credentials
+	if !decodeJSONBody(w, r, &creds) {
 		return
 	}
-
-	var creds Credentials
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if errs := validateStruct(creds); len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
 	defer cancel()
 
+	ip, userAgent := clientIP(r), r.UserAgent()
+
 	var user User
 	err := userCollection.FindOne(ctx, bson.M{"username": creds.Username}).Decode(&user)
 	if err == mongo.ErrNoDocuments {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		runInBackground(func() { recordLogin(creds.Username, ip, userAgent, false, loginFailureUnknownUser) })
+		writeError(w, http.StatusUnauthorized, errcode.InvalidCredentials, "Invalid username or password")
 		return
 	} else if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password)); err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		runInBackground(func() { recordLogin(creds.Username, ip, userAgent, false, loginFailureBadPassword) })
+		writeError(w, http.StatusUnauthorized, errcode.InvalidCredentials, "Invalid username or password")
 		return
 	}
 
-	expirationTime := time.Now().Add(1 * time.Hour)
-	claims := &Claims{
-		Username: creds.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   creds.Username,
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	ttl := tokenTTL
+	if creds.Remember {
+		ttl = rememberMeTokenTTL
 	}
 
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, claims, err := issueToken(ctx, r, &user, "", ttl)
 	if err != nil {
-		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Could not generate token")
 		return
 	}
+	runInBackground(func() { recordLogin(user.Username, ip, userAgent, true, "") })
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-		"username": creds.Username,
-	})
+	switch loginResponseShape(r) {
+	case loginShapeToken:
+		json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	case loginShapeClaims:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":  tokenString,
+			"claims": claimsResponse(claims),
+		})
+	default:
+		json.NewEncoder(w).Encode(map[string]string{
+			"token":    tokenString,
+			"username": creds.Username,
+		})
+	}
+}
+
+// newRouter maps each route to its handler by method and path. Patterns match
+// whole paths, so /authinfo/update and /authinfo/{username} are separate
+// routes and a user actually named "update" can still read their info.
+func newRouter() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", healthHandler)
+	mux.HandleFunc("GET /health/detail", healthDetailHandler)
+	mux.HandleFunc("GET /version", versionHandler)
+	mux.HandleFunc("POST /register", registerHandler)
+	mux.HandleFunc("POST /login", loginHandler)
+	mux.HandleFunc("POST /auth/oauth/google", googleSignInHandler)
+	mux.HandleFunc("GET /authinfo/{username}", getUserInfo)
+	mux.HandleFunc("PUT /authinfo/update", updateUserInfo)
+	if serviceAuthConfigured() {
+		mux.HandleFunc("PUT /internal/authinfo/update", requireServiceAuth(updateUserInfoInternal))
+	} else {
+		log.Println("SERVICE_SECRET is unset or the default; not serving internal routes")
+	}
+	mux.HandleFunc("GET /auth/sessions", listSessionsHandler)
+	mux.HandleFunc("DELETE /auth/sessions/{jti}", revokeSessionHandler)
+	mux.HandleFunc("POST /auth/logout-all", logoutAllHandler)
+	mux.HandleFunc("POST /auth/elevate", elevateHandler)
+	mux.HandleFunc("POST /auth/password", changePasswordHandler)
+	mux.HandleFunc("POST /auth/forgot", forgotPasswordHandler)
+	mux.HandleFunc("POST /auth/reset", resetPasswordHandler)
+	mux.HandleFunc("POST /admin/users/{username}/revoke-tokens", revokeUserTokensHandler)
+	return withoutTrailingSlash(mux)
 }
 
 func main() {
+	corsCfg, err := loadCORSConfig()
+	if err != nil {
+		log.Fatal("CORS config error: ", err)
+	}
+
+	emailSender, err = newEmailSender()
+	if err != nil {
+		log.Fatal("Email config error: ", err)
+	}
+
 	connectMongo()
-	http.HandleFunc("/register", registerHandler)
-	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/authinfo/", getUserInfo)
-	http.HandleFunc("/authinfo/update", updateUserInfo)
 
-	log.Println("Authentication service running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runJanitor(ctx, janitorInterval)
+
+	srv := &http.Server{
+		Addr:    ":8080",
+		Handler: withRecover(withCORS(corsCfg, withMaintenance(withJSONContentType(newRouter())))),
+	}
+	go func() {
+		log.Println("Authentication service running on :8080")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP shutdown error: %v", err)
+	}
+	if !waitUntil(shutdownCtx, &background) {
+		log.Println("Shutdown timed out waiting for background work")
+	}
+	if err := client.Disconnect(shutdownCtx); err != nil {
+		log.Printf("MongoDB disconnect error: %v", err)
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"AuthenticationService/errcode"
+)
+
+const roleAdmin = "admin"
+
+// validateAdminFromRequest requires an elevated token and then checks the
+// stored role rather than trusting a claim, so demoting an admin takes effect
+// immediately. Admins are granted by setting role: "admin" on the user record.
+func validateAdminFromRequest(ctx context.Context, r *http.Request) (*Claims, bool, error) {
+	claims, err := validateScopedJWTFromRequest(r, scopeTrade)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var user User
+	if err := userCollection.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&user); err != nil {
+		return claims, false, nil
+	}
+	return claims, user.Role == roleAdmin, nil
+}
+
+func currentTokenEpoch(ctx context.Context, username string) (int64, error) {
+	var user User
+	opts := options.FindOne().SetProjection(bson.M{"token_epoch": 1})
+	if err := userCollection.FindOne(ctx, bson.M{"username": username}, opts).Decode(&user); err != nil {
+		return 0, err
+	}
+	return user.TokenEpoch, nil
+}
+
+// POST /admin/users/{username}/revoke-tokens
+func revokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	claims, isAdmin, err := validateAdminFromRequest(ctx, r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if !isAdmin {
+		writeError(w, http.StatusForbidden, errcode.Forbidden, "Forbidden")
+		return
+	}
+
+	// Bumping the epoch is what invalidates outstanding tokens; deleting the
+	// sessions just keeps the user's session list accurate.
+	res, err := userCollection.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$inc": bson.M{"token_epoch": 1}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, errcode.UserNotFound, "User not found")
+		return
+	}
+	revoked, err := revokeAllSessions(ctx, username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+
+	log.Printf("Admin %s revoked all tokens for %s (%d sessions)", claims.Username, username, revoked)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username": username,
+		"revoked":  revoked,
+	})
+}
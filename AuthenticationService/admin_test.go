@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"AuthenticationService/errcode"
+)
+
+func TestRevokeUserTokens(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "root", Role: roleAdmin}, "adminpass")
+	env.addUser(t, User{Username: "alice"}, "password1")
+	admin := env.elevate(t, env.login(t, "root", "adminpass"), "adminpass")
+	before := env.login(t, "alice", "password1")
+	session := env.mongo.docs("sessions")[len(env.mongo.docs("sessions"))-1]
+
+	rec := env.call(http.MethodPost, "/admin/users/alice/revoke-tokens", "", admin)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Username string `json:"username"`
+		Revoked  int64  `json:"revoked"`
+	}
+	decodeJSON(t, rec, &body)
+	if body.Username != "alice" || body.Revoked != 1 {
+		t.Fatalf("revoke response = %+v", body)
+	}
+	if got := env.user(t, "alice").TokenEpoch; got != 1 {
+		t.Fatalf("token epoch = %d, want 1", got)
+	}
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", before), http.StatusUnauthorized, errcode.TokenInvalid)
+
+	// The epoch alone rejects the old token, even if its session record
+	// survives (e.g. written by another instance mid-revocation).
+	if _, err := sessionCollection.InsertOne(context.Background(), bson.M(session)); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", before), http.StatusUnauthorized, errcode.TokenInvalid)
+
+	after := env.login(t, "alice", "password1")
+	if rec := env.call(http.MethodGet, "/authinfo/alice", "", after); rec.Code != http.StatusOK {
+		t.Fatalf("token issued after revocation: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if epoch := parseClaims(t, after).Epoch; epoch != 1 {
+		t.Fatalf("new token epoch = %d, want 1", epoch)
+	}
+}
+
+func TestRevokeTokensOfUnknownUser(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "root", Role: roleAdmin}, "adminpass")
+	admin := env.elevate(t, env.login(t, "root", "adminpass"), "adminpass")
+
+	expectError(t, env.call(http.MethodPost, "/admin/users/nobody/revoke-tokens", "", admin), http.StatusNotFound, errcode.UserNotFound)
+}
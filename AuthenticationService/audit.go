@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GeoLookup maps a client IP to a coarse region (a country or similar). It is
+// only a hint for spotting logins from unusual places, so implementations
+// should be cheap and an empty region is always acceptable.
+type GeoLookup interface {
+	Region(ip string) (string, error)
+}
+
+// noopGeoLookup is the default: no region is recorded.
+type noopGeoLookup struct{}
+
+func (noopGeoLookup) Region(string) (string, error) { return "", nil }
+
+var geoLookup GeoLookup = noopGeoLookup{}
+
+// Reasons recorded on failed login events. A rejected Google ID token names
+// no user, so its event has an empty username.
+const (
+	loginFailureUnknownUser    = "unknown_user"
+	loginFailureBadPassword    = "bad_password"
+	loginFailureGoogleRejected = "google_token_rejected"
+)
+
+// loginEvent is one login attempt. NewRegion is set on a successful login from
+// a region the user hasn't logged in from before.
+type loginEvent struct {
+	Username  string    `bson:"username"`
+	Success   bool      `bson:"success"`
+	Reason    string    `bson:"reason,omitempty"`
+	IP        string    `bson:"ip"`
+	UserAgent string    `bson:"user_agent"`
+	Region    string    `bson:"region,omitempty"`
+	NewRegion bool      `bson:"new_region,omitempty"`
+	At        time.Time `bson:"at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+var auditCollection *mongo.Collection
+
+var loginAuditRetention = getEnvDuration("LOGIN_AUDIT_RETENTION", 90*24*time.Hour)
+
+func ensureAuditIndexes(ctx context.Context) error {
+	_, err := auditCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "region", Value: 1}},
+		},
+	})
+	return err
+}
+
+// recordLogin writes a login event. It runs off the request path (the geo
+// lookup may be remote), so failures are only logged.
+func recordLogin(username, ip, userAgent string, success bool, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	region, err := geoLookup.Region(ip)
+	if err != nil {
+		log.Printf("Geo lookup failed for %s: %v", ip, err)
+		region = ""
+	}
+
+	at := now()
+	event := loginEvent{
+		Username:  username,
+		Success:   success,
+		Reason:    reason,
+		IP:        ip,
+		UserAgent: userAgent,
+		Region:    region,
+		At:        at,
+		ExpiresAt: at.Add(loginAuditRetention),
+	}
+
+	if success && region != "" {
+		seen, err := auditCollection.CountDocuments(ctx, bson.M{"username": username, "region": region, "success": true})
+		if err != nil {
+			log.Printf("Error checking login regions for %s: %v", username, err)
+		} else if seen == 0 {
+			event.NewRegion = true
+			log.Printf("Login for %s from new region %s (%s)", username, region, ip)
+		}
+	}
+
+	if _, err := auditCollection.InsertOne(ctx, event); err != nil {
+		log.Printf("Error recording login event for %s: %v", username, err)
+	}
+}
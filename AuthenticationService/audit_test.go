@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// fakeGeoLookup maps IPs to regions; unknown IPs fail the lookup.
+type fakeGeoLookup map[string]string
+
+func (g fakeGeoLookup) Region(ip string) (string, error) {
+	if region, ok := g[ip]; ok {
+		return region, nil
+	}
+	return "", errors.New("no region for " + ip)
+}
+
+func loginFrom(env *testEnv, ip, password string) int {
+	req := jsonRequest(http.MethodPost, "/login", fmt.Sprintf(`{"username":"alice","password":%q}`, password), "")
+	req.RemoteAddr = ip + ":40000"
+	code := env.serve(req).Code
+	background.Wait()
+	return code
+}
+
+func TestLoginAuditRecordsRegion(t *testing.T) {
+	env := newTestEnv(t)
+	override[GeoLookup](t, &geoLookup, fakeGeoLookup{
+		"203.0.113.1":  "NZ",
+		"203.0.113.2":  "NZ",
+		"198.51.100.1": "US",
+	})
+	env.addUser(t, User{Username: "alice"}, "password1")
+
+	steps := []struct {
+		ip, password string
+		status       int
+		region       string
+		newRegion    bool
+	}{
+		{"203.0.113.1", "password1", http.StatusOK, "NZ", true},
+		{"203.0.113.2", "password1", http.StatusOK, "NZ", false},
+		// A failed login records the region but doesn't make it familiar.
+		{"198.51.100.1", "wrong", http.StatusUnauthorized, "US", false},
+		{"198.51.100.1", "password1", http.StatusOK, "US", true},
+		// A failed lookup still records the login, just without a region.
+		{"192.0.2.1", "password1", http.StatusOK, "", false},
+	}
+	for i, step := range steps {
+		if code := loginFrom(env, step.ip, step.password); code != step.status {
+			t.Fatalf("login %d from %s: status %d, want %d", i, step.ip, code, step.status)
+		}
+	}
+
+	events := env.mongo.docs("login_audit")
+	if len(events) != len(steps) {
+		t.Fatalf("recorded %d events, want %d: %v", len(events), len(steps), events)
+	}
+	for i, step := range steps {
+		region, _ := events[i]["region"].(string)
+		newRegion, _ := events[i]["new_region"].(bool)
+		if events[i]["ip"] != step.ip || region != step.region || newRegion != step.newRegion {
+			t.Errorf("event %d = %v, want ip %s region %q new_region %v", i, events[i], step.ip, step.region, step.newRegion)
+		}
+	}
+}
+
+func TestGoogleSignInIsAudited(t *testing.T) {
+	env := newTestEnv(t)
+	override[GeoLookup](t, &geoLookup, fakeGeoLookup{"203.0.113.1": "NZ"})
+	override[googleTokenVerifier](t, &googleVerifier, stubVerifier{
+		"alice-token": {Subject: "g-alice", Email: "alice@example.com"},
+	})
+
+	signIn := func(idToken string) int {
+		req := jsonRequest(http.MethodPost, "/auth/oauth/google", `{"id_token":"`+idToken+`"}`, "")
+		req.RemoteAddr = "203.0.113.1:40000"
+		code := env.serve(req).Code
+		background.Wait()
+		return code
+	}
+	for i, step := range []struct {
+		idToken string
+		status  int
+	}{
+		{"alice-token", http.StatusCreated},
+		{"alice-token", http.StatusOK},
+		{"forged", http.StatusUnauthorized},
+	} {
+		if code := signIn(step.idToken); code != step.status {
+			t.Fatalf("sign-in %d: status %d, want %d", i, code, step.status)
+		}
+	}
+
+	events := env.mongo.docs("login_audit")
+	if len(events) != 3 {
+		t.Fatalf("recorded %d events, want 3: %v", len(events), events)
+	}
+	for i, want := range []struct {
+		username  string
+		success   bool
+		reason    string
+		newRegion bool
+	}{
+		{"alice", true, "", true},
+		{"alice", true, "", false},
+		{"", false, loginFailureGoogleRejected, false},
+	} {
+		username, _ := events[i]["username"].(string)
+		reason, _ := events[i]["reason"].(string)
+		newRegion, _ := events[i]["new_region"].(bool)
+		if username != want.username || events[i]["success"] != want.success || reason != want.reason ||
+			newRegion != want.newRegion || events[i]["region"] != "NZ" {
+			t.Errorf("event %d = %v, want %+v in NZ", i, events[i], want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	"AuthenticationService/errcode"
+)
+
+// Request bodies here are small credential payloads, so both limits are far
+// above anything a legitimate client sends.
+const (
+	maxBodyBytes = 64 << 10
+	maxJSONDepth = 32
+)
+
+var errJSONTooDeep = errors.New("JSON nested too deeply")
+
+// decodeJSONBody reads r's body into dst, refusing oversized bodies and
+// pathologically nested documents before they reach the decoder. On failure it
+// writes the error response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, errcode.InvalidRequest, "Request body too large")
+			return false
+		}
+		writeError(w, http.StatusBadRequest, errcode.InvalidRequest, "Invalid request")
+		return false
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		writeError(w, http.StatusBadRequest, errcode.InvalidRequest, "Request body is required")
+		return false
+	}
+
+	if err := checkJSONDepth(body, maxJSONDepth); err != nil {
+		writeError(w, http.StatusBadRequest, errcode.InvalidRequest, "Invalid request: "+err.Error())
+		return false
+	}
+
+	if err := json.Unmarshal(body, dst); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			writeError(w, http.StatusBadRequest, errcode.InvalidRequest, "Malformed JSON")
+			return false
+		}
+		// Payload fields end up as Mongo query values, so a JSON object where
+		// a string belongs (e.g. {"username": {"$ne": ""}}) must never get
+		// through. The typed decode already refuses it; say which field.
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			writeError(w, http.StatusBadRequest, errcode.InvalidRequest,
+				fmt.Sprintf("Invalid request: field %s must be %s", typeErr.Field, jsonTypeName(typeErr.Type)))
+			return false
+		}
+		writeError(w, http.StatusBadRequest, errcode.InvalidRequest, "Invalid request")
+		return false
+	}
+	return true
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// checkJSONDepth scans raw JSON and fails once objects/arrays nest beyond
+// limit. It only tracks brackets outside of strings; whether the document is
+// otherwise valid is left to the decoder.
+func checkJSONDepth(data []byte, limit int) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > limit {
+				return errJSONTooDeep
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return nil
+}
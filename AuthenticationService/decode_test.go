@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"AuthenticationService/errcode"
+)
+
+func decodeRequest(t *testing.T, body string) (*httptest.ResponseRecorder, bool) {
+	t.Helper()
+	var creds Credentials
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+	return rec, decodeJSONBody(rec, req, &creds)
+}
+
+func TestDecodeJSONBodyEmptyAndMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"empty", "", "Request body is required"},
+		{"whitespace", "  \n", "Request body is required"},
+		{"malformed", `{"username": "alice",`, "Malformed JSON"},
+		{"garbage", `username=alice`, "Malformed JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, ok := decodeRequest(t, tt.body)
+			if ok {
+				t.Fatal("decode succeeded")
+			}
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", rec.Code)
+			}
+			code, message := errorResponse(t, rec)
+			if code != errcode.InvalidRequest || message != tt.message {
+				t.Fatalf("got %s %q, want %s %q", code, message, errcode.InvalidRequest, tt.message)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONBodyValid(t *testing.T) {
+	var creds Credentials
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice","password":"secret"}`))
+	if !decodeJSONBody(rec, req, &creds) {
+		t.Fatalf("decode failed: %s", rec.Body.String())
+	}
+	if creds.Username != "alice" || creds.Password != "secret" {
+		t.Fatalf("decoded %+v", creds)
+	}
+}
+
+func nestedBody(depth int) string {
+	// The outer object is the first level.
+	return `{"username":"alice","password":"secret","extra":` + strings.Repeat("[", depth-1) + strings.Repeat("]", depth-1) + `}`
+}
+
+func TestDecodeJSONBodyRejectsDeepNesting(t *testing.T) {
+	rec, ok := decodeRequest(t, nestedBody(maxJSONDepth+1))
+	if ok {
+		t.Fatal("deeply nested body was decoded")
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	if code, message := errorResponse(t, rec); code != errcode.InvalidRequest || message != "Invalid request: "+errJSONTooDeep.Error() {
+		t.Fatalf("got %s %q", code, message)
+	}
+
+	if rec, ok := decodeRequest(t, nestedBody(maxJSONDepth)); !ok {
+		t.Fatalf("body at the depth limit refused: %s", rec.Body.String())
+	}
+	// Brackets inside strings aren't nesting.
+	if rec, ok := decodeRequest(t, `{"username":"`+strings.Repeat("[{", 100)+`","password":"secret"}`); !ok {
+		t.Fatalf("brackets in a string refused: %s", rec.Body.String())
+	}
+}
+
+func TestDecodeJSONBodyRejectsOversizedBody(t *testing.T) {
+	rec, ok := decodeRequest(t, `{"username":"`+strings.Repeat("a", maxBodyBytes)+`"}`)
+	if ok {
+		t.Fatal("oversized body was decoded")
+	}
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+}
+
+func TestObjectWhereStringExpectedIsRejected(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice", Email: "alice@example.com"}, "password1")
+
+	cases := []struct {
+		path, body, message string
+	}{
+		{"/login", `{"username":{"$ne":""},"password":"password1"}`, "Invalid request: field username must be a string"},
+		{"/login", `{"username":"alice","password":{"$gt":""}}`, "Invalid request: field password must be a string"},
+		{"/register", `{"username":{"$ne":null},"password":"password1","name":"x"}`, "Invalid request: field username must be a string"},
+		{"/auth/forgot", `{"login":{"$regex":".*"}}`, "Invalid request: field login must be a string"},
+		{"/login", `{"username":["alice"],"password":"password1"}`, "Invalid request: field username must be a string"},
+	}
+	for _, tc := range cases {
+		rec := env.call(http.MethodPost, tc.path, tc.body, "")
+		expectError(t, rec, http.StatusBadRequest, errcode.InvalidRequest)
+		if _, message := errorResponse(t, rec); message != tc.message {
+			t.Errorf("%s %s: message %q, want %q", tc.path, tc.body, message, tc.message)
+		}
+	}
+	if sent := env.mail.messages(); len(sent) != 0 {
+		t.Fatalf("an injected login triggered %d reset emails", len(sent))
+	}
+}
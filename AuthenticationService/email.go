@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EmailSender delivers transactional email (password resets and the like).
+// Handlers only depend on this interface so the provider can be swapped.
+type EmailSender interface {
+	Send(to, subject, body string) error
+}
+
+// logEmailSender writes messages to the log instead of sending them. It is
+// the default so development setups work without a mail server.
+type logEmailSender struct{}
+
+func (logEmailSender) Send(to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// smtpEmailSender sends plain-text mail through an SMTP relay. Auth is only
+// used when a username is configured, so an unauthenticated local relay works.
+// The whole exchange is bounded by timeout: sends run in the background and
+// shutdown waits for them, so a hung relay must not block forever.
+type smtpEmailSender struct {
+	addr    string
+	auth    smtp.Auth
+	from    string
+	timeout time.Duration
+}
+
+func (s smtpEmailSender) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("email header contains a line break")
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		s.from, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+	return s.deliver(to, []byte(msg))
+}
+
+// deliver is smtp.SendMail over a connection with a deadline.
+func (s smtpEmailSender) deliver(to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	host, _, _ := net.SplitHostPort(s.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+var emailSender EmailSender = logEmailSender{}
+
+// newEmailSender picks the sender from the environment: SMTP when SMTP_HOST is
+// set, otherwise the logging default.
+func newEmailSender() (EmailSender, error) {
+	host := getEnv("SMTP_HOST", "")
+	if host == "" {
+		return logEmailSender{}, nil
+	}
+
+	from := getEnv("SMTP_FROM", "")
+	if from == "" {
+		return nil, errors.New("SMTP_FROM must be set when SMTP_HOST is")
+	}
+
+	sender := smtpEmailSender{
+		addr:    net.JoinHostPort(host, getEnv("SMTP_PORT", "587")),
+		from:    from,
+		timeout: getEnvDuration("SMTP_TIMEOUT", 10*time.Second),
+	}
+	if user := getEnv("SMTP_USERNAME", ""); user != "" {
+		sender.auth = smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return sender, nil
+}
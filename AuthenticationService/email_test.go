@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResetEmailContents(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &passwordResetURL, "https://app.example.com/reset")
+	env.addUser(t, User{Username: "alice", Email: "alice@example.com"}, "password1")
+
+	token := requestReset(t, env, "alice")
+	sent := env.mail.messages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(sent))
+	}
+	msg := sent[0]
+	if msg.to != "alice@example.com" || msg.subject != "Reset your password" {
+		t.Fatalf("email to %s with subject %q", msg.to, msg.subject)
+	}
+	if !strings.Contains(msg.body, "https://app.example.com/reset?token="+token) {
+		t.Fatalf("body has no reset link: %q", msg.body)
+	}
+	if !strings.Contains(msg.body, "expires in "+passwordResetTTL.String()) {
+		t.Fatalf("body doesn't say when the link expires: %q", msg.body)
+	}
+
+	// Only the hash is stored; the token itself lives in the email alone.
+	resets := env.mongo.docs("password_resets")
+	if len(resets) != 1 || resets[0]["token_hash"] != hashResetToken(token) {
+		t.Fatalf("stored resets = %v", resets)
+	}
+}
+
+func TestNewEmailSender(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	sender, err := newEmailSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sender.(logEmailSender); !ok {
+		t.Fatalf("without SMTP_HOST got %T, want the logging sender", sender)
+	}
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_FROM", "")
+	if _, err := newEmailSender(); err == nil {
+		t.Fatal("SMTP_HOST without SMTP_FROM was accepted")
+	}
+
+	t.Setenv("SMTP_FROM", "noreply@example.com")
+	t.Setenv("SMTP_PORT", "2525")
+	t.Setenv("SMTP_USERNAME", "")
+	sender, err = newEmailSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpSender, ok := sender.(smtpEmailSender)
+	if !ok {
+		t.Fatalf("with SMTP_HOST got %T, want smtpEmailSender", sender)
+	}
+	if smtpSender.addr != "smtp.example.com:2525" || smtpSender.from != "noreply@example.com" || smtpSender.auth != nil {
+		t.Fatalf("smtp sender = %+v", smtpSender)
+	}
+
+	t.Setenv("SMTP_USERNAME", "mailer")
+	t.Setenv("SMTP_PASSWORD", "pw")
+	sender, err = newEmailSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender.(smtpEmailSender).auth == nil {
+		t.Fatal("SMTP_USERNAME set but no auth configured")
+	}
+}
+
+func TestSMTPSenderRefusesHeaderInjection(t *testing.T) {
+	sender := smtpEmailSender{addr: "127.0.0.1:1", from: "noreply@example.com"}
+	for _, to := range []string{"a@example.com\r\nBcc: all@example.com", "a@example.com\nBcc: x"} {
+		if err := sender.Send(to, "Hi", "body"); err == nil || !strings.Contains(err.Error(), "line break") {
+			t.Fatalf("Send(%q) = %v", to, err)
+		}
+	}
+	if err := sender.Send("a@example.com", "Hi\r\nBcc: x", "body"); err == nil || !strings.Contains(err.Error(), "line break") {
+		t.Fatalf("subject injection = %v", err)
+	}
+}
+
+// fakeSMTPServer accepts one connection on a local port and runs serve on it.
+func fakeSMTPServer(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestSMTPSenderDelivers(t *testing.T) {
+	received := make(chan string, 1)
+	addr := fakeSMTPServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 fake ESMTP\r\n")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					fmt.Fprint(conn, "250 queued\r\n")
+				} else {
+					data.WriteString(line)
+				}
+				continue
+			}
+			switch strings.ToUpper(strings.Fields(line)[0]) {
+			case "DATA":
+				inData = true
+				fmt.Fprint(conn, "354 go ahead\r\n")
+			case "QUIT":
+				fmt.Fprint(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	})
+
+	sender := smtpEmailSender{addr: addr, from: "noreply@example.com", timeout: 5 * time.Second}
+	if err := sender.Send("alice@example.com", "Hi", "line one\nline two"); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-received
+	if !strings.Contains(msg, "To: alice@example.com\r\n") || !strings.Contains(msg, "line one\r\nline two") {
+		t.Fatalf("server received %q", msg)
+	}
+}
+
+func TestSMTPSenderTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	// The relay accepts the connection and then never says anything.
+	addr := fakeSMTPServer(t, func(net.Conn) { <-release })
+
+	sender := smtpEmailSender{addr: addr, from: "noreply@example.com", timeout: 50 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() { done <- sender.Send("alice@example.com", "Hi", "body") }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("send to a silent relay succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send to a silent relay never gave up")
+	}
+}
@@ -0,0 +1,35 @@
+// Package errcode lists the machine-readable codes carried in the "code" field
+// of every JSON error response. Clients should branch on these rather than on
+// the human-readable "error" message, which may change.
+//
+// The Python user service can't import this package, so it keeps the same
+// strings in its ErrorCode class (UserServices/userservices.py). The two lists
+// are one contract: a code added to either belongs in both.
+package errcode
+
+const (
+	InvalidRequest       = "INVALID_REQUEST"
+	ValidationFailed     = "VALIDATION_FAILED"
+	UnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	Unauthorized         = "UNAUTHORIZED"
+	Forbidden            = "FORBIDDEN"
+	InsufficientScope    = "INSUFFICIENT_SCOPE"
+	RateLimited          = "RATE_LIMITED"
+	Maintenance          = "MAINTENANCE"
+	Internal             = "INTERNAL_ERROR"
+
+	TokenExpired       = "TOKEN_EXPIRED"
+	TokenInvalid       = "TOKEN_INVALID"
+	InvalidCredentials = "INVALID_CREDENTIALS"
+	UsernameTaken      = "USERNAME_TAKEN"
+	EmailTaken         = "EMAIL_TAKEN"
+	PasswordReused     = "PASSWORD_REUSED"
+	ResetTokenInvalid  = "RESET_TOKEN_INVALID"
+	UserNotFound       = "USER_NOT_FOUND"
+	SessionNotFound    = "SESSION_NOT_FOUND"
+
+	// Returned by the user service only.
+	ProfileNotFound     = "PROFILE_NOT_FOUND"
+	ProfileExists       = "PROFILE_EXISTS"
+	PreferencesNotFound = "PREFERENCES_NOT_FOUND"
+)
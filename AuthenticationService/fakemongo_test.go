@@ -0,0 +1,915 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// fakeMongo is an in-memory stand-in for a MongoDB server. It plugs into the
+// driver as a custom deployment and answers the handful of commands this
+// service sends (find, insert, update, delete, findAndModify, count
+// aggregations, createIndexes, ping), so handlers run end to end in tests
+// without a database. Only the query and update operators the service uses
+// are implemented; anything else fails the command loudly.
+type fakeMongo struct {
+	mu          sync.Mutex
+	collections map[string]*fakeCollection
+	down        bool
+	updates     chan description.Topology
+	// onCommand, when set, sees each command with the context it was sent
+	// under, so tests can check the deadline an operation ran with.
+	onCommand func(ctx context.Context, cmd bson.D)
+}
+
+type fakeCollection struct {
+	docs    []bson.M
+	indexes []fakeIndex
+}
+
+type fakeIndex struct {
+	name   string
+	keys   []string
+	unique bool
+	sparse bool
+}
+
+func newFakeMongo() *fakeMongo {
+	return &fakeMongo{collections: map[string]*fakeCollection{}}
+}
+
+// setDown makes every server selection fail, as if Mongo were unreachable.
+func (m *fakeMongo) setDown(down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down = down
+}
+
+func (m *fakeMongo) setOnCommand(fn func(ctx context.Context, cmd bson.D)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onCommand = fn
+}
+
+// docs returns the documents currently stored in the named collection.
+func (m *fakeMongo) docs(name string) []bson.M {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	coll := m.collections[name]
+	if coll == nil {
+		return nil
+	}
+	out := make([]bson.M, len(coll.docs))
+	for i, doc := range coll.docs {
+		out[i] = normalize(doc).(bson.M)
+	}
+	return out
+}
+
+func (m *fakeMongo) collection(name string) *fakeCollection {
+	coll := m.collections[name]
+	if coll == nil {
+		coll = &fakeCollection{}
+		m.collections[name] = coll
+	}
+	return coll
+}
+
+var fakeDescription = description.Server{
+	CanonicalAddr:            address.Address("fake:27017"),
+	MaxDocumentSize:          16 * 1024 * 1024,
+	MaxMessageSize:           48000000,
+	MaxBatchCount:            100000,
+	SessionTimeoutMinutes:    30,
+	SessionTimeoutMinutesPtr: func() *int64 { n := int64(30); return &n }(),
+	Kind:                     description.RSPrimary,
+	WireVersion:              &description.VersionRange{Max: topology.SupportedWireVersions.Max},
+}
+
+var (
+	_ driver.Deployment   = (*fakeMongo)(nil)
+	_ driver.Server       = (*fakeMongo)(nil)
+	_ driver.Connector    = (*fakeMongo)(nil)
+	_ driver.Disconnector = (*fakeMongo)(nil)
+	_ driver.Subscriber   = (*fakeMongo)(nil)
+)
+
+func (m *fakeMongo) SelectServer(context.Context, description.ServerSelector) (driver.Server, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.down {
+		return nil, errors.New("fake mongo is down")
+	}
+	return m, nil
+}
+
+func (m *fakeMongo) Kind() description.TopologyKind { return description.Single }
+
+func (m *fakeMongo) Connection(context.Context) (driver.Connection, error) {
+	return &fakeConn{mongo: m}, nil
+}
+
+func (m *fakeMongo) RTTMonitor() driver.RTTMonitor { return zeroRTTMonitor{} }
+
+func (m *fakeMongo) Connect() error { return nil }
+
+func (m *fakeMongo) Disconnect(context.Context) error {
+	if m.updates != nil {
+		close(m.updates)
+	}
+	return nil
+}
+
+func (m *fakeMongo) Subscribe() (*driver.Subscription, error) {
+	if m.updates == nil {
+		m.updates = make(chan description.Topology, 1)
+		m.updates <- description.Topology{
+			SessionTimeoutMinutes:    30,
+			SessionTimeoutMinutesPtr: fakeDescription.SessionTimeoutMinutesPtr,
+		}
+	}
+	return &driver.Subscription{Updates: m.updates}, nil
+}
+
+func (m *fakeMongo) Unsubscribe(*driver.Subscription) error { return nil }
+
+type zeroRTTMonitor struct{}
+
+func (zeroRTTMonitor) EWMA() time.Duration { return 0 }
+func (zeroRTTMonitor) Min() time.Duration  { return 0 }
+func (zeroRTTMonitor) P90() time.Duration  { return 0 }
+func (zeroRTTMonitor) Stats() string       { return "" }
+
+// fakeConn runs each command as it is written and hands back the reply on the
+// following read. Every operation gets its own connection, so concurrent
+// callers never see each other's replies.
+type fakeConn struct {
+	mongo *fakeMongo
+	reply []byte
+}
+
+func (c *fakeConn) WriteWireMessage(ctx context.Context, wm []byte) error {
+	cmd, err := parseOpMsg(wm)
+	if err != nil {
+		return err
+	}
+	c.mongo.mu.Lock()
+	onCommand := c.mongo.onCommand
+	c.mongo.mu.Unlock()
+	if onCommand != nil {
+		onCommand(ctx, cmd)
+	}
+	c.reply = encodeOpMsg(c.mongo.run(cmd))
+	return nil
+}
+
+func (c *fakeConn) ReadWireMessage(context.Context) ([]byte, error) {
+	if c.reply == nil {
+		return nil, errors.New("fake mongo: read without a command")
+	}
+	reply := c.reply
+	c.reply = nil
+	return reply, nil
+}
+
+func (c *fakeConn) Description() description.Server { return fakeDescription }
+func (c *fakeConn) Close() error                    { return nil }
+func (c *fakeConn) ID() string                      { return "fake" }
+func (c *fakeConn) ServerConnectionID() *int64      { n := int64(1); return &n }
+func (c *fakeConn) DriverConnectionID() uint64      { return 1 }
+func (c *fakeConn) Address() address.Address        { return fakeDescription.CanonicalAddr }
+func (c *fakeConn) Stale() bool                     { return false }
+func (c *fakeConn) OIDCTokenGenID() uint64          { return 0 }
+func (c *fakeConn) SetOIDCTokenGenID(uint64)        {}
+
+// parseOpMsg decodes an OP_MSG into its command document, folding any
+// document sequences (insert's "documents", update's "updates", ...) back in
+// as arrays.
+func parseOpMsg(wm []byte) (bson.D, error) {
+	_, _, _, opcode, rem, ok := wiremessage.ReadHeader(wm)
+	if !ok || opcode != wiremessage.OpMsg {
+		return nil, fmt.Errorf("fake mongo: unsupported wire message opcode %v", opcode)
+	}
+	if _, rem, ok = wiremessage.ReadMsgFlags(rem); !ok {
+		return nil, errors.New("fake mongo: malformed OP_MSG flags")
+	}
+
+	var cmd bson.D
+	for len(rem) > 0 {
+		var stype wiremessage.SectionType
+		if stype, rem, ok = wiremessage.ReadMsgSectionType(rem); !ok {
+			return nil, errors.New("fake mongo: malformed OP_MSG section")
+		}
+		switch stype {
+		case wiremessage.SingleDocument:
+			var doc bsoncore.Document
+			if doc, rem, ok = wiremessage.ReadMsgSectionSingleDocument(rem); !ok {
+				return nil, errors.New("fake mongo: malformed OP_MSG body")
+			}
+			var body bson.D
+			if err := bson.Unmarshal(doc, &body); err != nil {
+				return nil, err
+			}
+			cmd = append(body, cmd...)
+		case wiremessage.DocumentSequence:
+			var identifier string
+			var docs []bsoncore.Document
+			if identifier, docs, rem, ok = wiremessage.ReadMsgSectionDocumentSequence(rem); !ok {
+				return nil, errors.New("fake mongo: malformed OP_MSG document sequence")
+			}
+			seq := bson.A{}
+			for _, doc := range docs {
+				var d bson.D
+				if err := bson.Unmarshal(doc, &d); err != nil {
+					return nil, err
+				}
+				seq = append(seq, d)
+			}
+			cmd = append(cmd, bson.E{Key: identifier, Value: seq})
+		default:
+			return nil, fmt.Errorf("fake mongo: unsupported section type %v", stype)
+		}
+	}
+	return cmd, nil
+}
+
+func encodeOpMsg(reply bson.D) []byte {
+	body, err := bson.Marshal(reply)
+	if err != nil {
+		body, _ = bson.Marshal(bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: err.Error()}})
+	}
+	idx, dst := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), 0, wiremessage.OpMsg)
+	dst = wiremessage.AppendMsgFlags(dst, 0)
+	dst = wiremessage.AppendMsgSectionType(dst, wiremessage.SingleDocument)
+	dst = append(dst, body...)
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
+
+// fakeCommandError is raised (via panic) for anything the fake doesn't
+// support, and turned into a failed command reply.
+type fakeCommandError string
+
+func (m *fakeMongo) run(cmd bson.D) (reply bson.D) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			msg, ok := rec.(fakeCommandError)
+			if !ok {
+				panic(rec)
+			}
+			reply = bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: string(msg)}, {Key: "code", Value: 2}}
+		}
+	}()
+
+	if len(cmd) == 0 {
+		panic(fakeCommandError("empty command"))
+	}
+	name := cmd[0].Key
+	collName, _ := cmd[0].Value.(string)
+	ns := fmt.Sprint(field(cmd, "$db")) + "." + collName
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch name {
+	case "ping", "endSessions", "killCursors":
+		return okReply()
+	case "createIndexes":
+		return m.createIndexes(collName, cmd)
+	case "insert":
+		return m.insert(collName, ns, cmd)
+	case "find":
+		return m.find(collName, ns, cmd)
+	case "update":
+		return m.update(collName, cmd)
+	case "delete":
+		return m.delete(collName, cmd)
+	case "findAndModify":
+		return m.findAndModify(collName, cmd)
+	case "aggregate":
+		return m.aggregate(collName, ns, cmd)
+	}
+	panic(fakeCommandError("unsupported command " + name))
+}
+
+func okReply(fields ...bson.E) bson.D {
+	return append(bson.D{{Key: "ok", Value: 1}}, fields...)
+}
+
+func field(d bson.D, key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+func docField(d bson.D, key string) bson.M {
+	v := field(d, key)
+	if v == nil {
+		return bson.M{}
+	}
+	return normalize(v).(bson.M)
+}
+
+func arrayField(d bson.D, key string) []interface{} {
+	v, _ := normalize(field(d, key)).([]interface{})
+	return v
+}
+
+func (m *fakeMongo) createIndexes(collName string, cmd bson.D) bson.D {
+	coll := m.collection(collName)
+	before := len(coll.indexes)
+	for _, spec := range arrayField(cmd, "indexes") {
+		spec := spec.(bson.M)
+		var keys []string
+		for _, e := range toDOrdered(spec["key"]) {
+			keys = append(keys, e.Key)
+		}
+		name, _ := spec["name"].(string)
+		coll.indexes = append(coll.indexes, fakeIndex{
+			name:   name,
+			keys:   keys,
+			unique: spec["unique"] == true,
+			sparse: spec["sparse"] == true,
+		})
+	}
+	return okReply(
+		bson.E{Key: "numIndexesBefore", Value: before + 1},
+		bson.E{Key: "numIndexesAfter", Value: len(coll.indexes) + 1},
+	)
+}
+
+func (m *fakeMongo) insert(collName, ns string, cmd bson.D) bson.D {
+	coll := m.collection(collName)
+	n := 0
+	var writeErrors bson.A
+	for i, raw := range arrayField(cmd, "documents") {
+		doc := raw.(bson.M)
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = primitive.NewObjectID()
+		}
+		if dup := coll.duplicateOf(doc, nil); dup != nil {
+			writeErrors = append(writeErrors, duplicateKeyError(i, ns, dup, doc))
+			break
+		}
+		coll.docs = append(coll.docs, doc)
+		n++
+	}
+	reply := okReply(bson.E{Key: "n", Value: n})
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+	}
+	return reply
+}
+
+// duplicateOf returns the unique index that doc would violate, ignoring the
+// stored document self (when doc is an update of it).
+func (c *fakeCollection) duplicateOf(doc bson.M, self bson.M) *fakeIndex {
+	for i := range c.indexes {
+		idx := &c.indexes[i]
+		if !idx.unique {
+			continue
+		}
+		if idx.sparse && !hasAnyField(doc, idx.keys) {
+			continue
+		}
+		for _, other := range c.docs {
+			if self != nil && reflect.ValueOf(other).Pointer() == reflect.ValueOf(self).Pointer() {
+				continue
+			}
+			if idx.sparse && !hasAnyField(other, idx.keys) {
+				continue
+			}
+			same := true
+			for _, key := range idx.keys {
+				a, _ := lookup(doc, key)
+				b, _ := lookup(other, key)
+				if !valuesEqual(a, b) {
+					same = false
+					break
+				}
+			}
+			if same {
+				return idx
+			}
+		}
+	}
+	return nil
+}
+
+func hasAnyField(doc bson.M, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := lookup(doc, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func duplicateKeyError(index int, ns string, idx *fakeIndex, doc bson.M) bson.D {
+	pattern, value := bson.D{}, bson.D{}
+	for _, key := range idx.keys {
+		v, _ := lookup(doc, key)
+		pattern = append(pattern, bson.E{Key: key, Value: 1})
+		value = append(value, bson.E{Key: key, Value: v})
+	}
+	return bson.D{
+		{Key: "index", Value: index},
+		{Key: "code", Value: 11000},
+		{Key: "keyPattern", Value: pattern},
+		{Key: "keyValue", Value: value},
+		{Key: "errmsg", Value: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: %v", ns, idx.name, value)},
+	}
+}
+
+func (m *fakeMongo) matching(collName string, filter bson.M, sortSpec bson.D) []bson.M {
+	var out []bson.M
+	for _, doc := range m.collection(collName).docs {
+		if matches(doc, filter) {
+			out = append(out, doc)
+		}
+	}
+	if len(sortSpec) > 0 {
+		sort.SliceStable(out, func(i, j int) bool {
+			for _, e := range sortSpec {
+				a, _ := lookup(out[i], e.Key)
+				b, _ := lookup(out[j], e.Key)
+				c, _ := compareValues(a, b)
+				if c == 0 {
+					continue
+				}
+				if toInt(e.Value) < 0 {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+	}
+	return out
+}
+
+func cursorReply(ns string, docs []bson.M) bson.D {
+	batch := bson.A{}
+	for _, doc := range docs {
+		batch = append(batch, doc)
+	}
+	return okReply(bson.E{Key: "cursor", Value: bson.D{
+		{Key: "firstBatch", Value: batch},
+		{Key: "id", Value: int64(0)},
+		{Key: "ns", Value: ns},
+	}})
+}
+
+func (m *fakeMongo) find(collName, ns string, cmd bson.D) bson.D {
+	docs := m.matching(collName, docField(cmd, "filter"), toDOrdered(field(cmd, "sort")))
+	if skip := toInt(field(cmd, "skip")); skip > 0 {
+		docs = docs[min(skip, len(docs)):]
+	}
+	if limit := toInt(field(cmd, "limit")); limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	return cursorReply(ns, docs)
+}
+
+func (m *fakeMongo) update(collName string, cmd bson.D) bson.D {
+	coll := m.collection(collName)
+	matched, modified := 0, 0
+	var upserted bson.A
+	for i, raw := range arrayField(cmd, "updates") {
+		spec := raw.(bson.M)
+		filter, _ := spec["q"].(bson.M)
+		update, _ := spec["u"].(bson.M)
+		docs := m.matching(collName, filter, nil)
+		if spec["multi"] != true && len(docs) > 1 {
+			docs = docs[:1]
+		}
+		if len(docs) == 0 && spec["upsert"] == true {
+			doc := bson.M{"_id": primitive.NewObjectID()}
+			for k, v := range filter {
+				if !strings.HasPrefix(k, "$") {
+					if _, isOp := v.(bson.M); !isOp {
+						doc[k] = v
+					}
+				}
+			}
+			applyUpdate(doc, update)
+			coll.docs = append(coll.docs, doc)
+			upserted = append(upserted, bson.D{{Key: "index", Value: i}, {Key: "_id", Value: doc["_id"]}})
+			continue
+		}
+		for _, doc := range docs {
+			applyUpdate(doc, update)
+		}
+		matched += len(docs)
+		modified += len(docs)
+	}
+	reply := okReply(bson.E{Key: "n", Value: matched + len(upserted)}, bson.E{Key: "nModified", Value: modified})
+	if len(upserted) > 0 {
+		reply = append(reply, bson.E{Key: "upserted", Value: upserted})
+	}
+	return reply
+}
+
+func (c *fakeCollection) remove(doc bson.M) {
+	for i, other := range c.docs {
+		if reflect.ValueOf(other).Pointer() == reflect.ValueOf(doc).Pointer() {
+			c.docs = append(c.docs[:i], c.docs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *fakeMongo) delete(collName string, cmd bson.D) bson.D {
+	coll := m.collection(collName)
+	n := 0
+	for _, raw := range arrayField(cmd, "deletes") {
+		spec := raw.(bson.M)
+		filter, _ := spec["q"].(bson.M)
+		docs := m.matching(collName, filter, nil)
+		if toInt(spec["limit"]) == 1 && len(docs) > 1 {
+			docs = docs[:1]
+		}
+		for _, doc := range docs {
+			coll.remove(doc)
+		}
+		n += len(docs)
+	}
+	return okReply(bson.E{Key: "n", Value: n})
+}
+
+func (m *fakeMongo) findAndModify(collName string, cmd bson.D) bson.D {
+	coll := m.collection(collName)
+	docs := m.matching(collName, docField(cmd, "query"), toDOrdered(field(cmd, "sort")))
+	if len(docs) == 0 {
+		return okReply(bson.E{Key: "value", Value: nil}, bson.E{Key: "lastErrorObject", Value: bson.D{{Key: "n", Value: 0}}})
+	}
+	doc := docs[0]
+	value := normalize(doc).(bson.M)
+	switch {
+	case field(cmd, "remove") == true:
+		coll.remove(doc)
+	default:
+		applyUpdate(doc, docField(cmd, "update"))
+		if field(cmd, "new") == true {
+			value = normalize(doc).(bson.M)
+		}
+	}
+	return okReply(bson.E{Key: "value", Value: value}, bson.E{Key: "lastErrorObject", Value: bson.D{{Key: "n", Value: 1}}})
+}
+
+// aggregate supports the pipelines CountDocuments builds: $match, optional
+// $skip/$limit, then a $group summing 1.
+func (m *fakeMongo) aggregate(collName, ns string, cmd bson.D) bson.D {
+	var docs []bson.M
+	first := true
+	for _, raw := range arrayField(cmd, "pipeline") {
+		stage := raw.(bson.M)
+		switch {
+		case stage["$match"] != nil:
+			docs = m.matching(collName, stage["$match"].(bson.M), nil)
+			first = false
+		case stage["$skip"] != nil:
+			docs = docs[min(toInt(stage["$skip"]), len(docs)):]
+		case stage["$limit"] != nil:
+			docs = docs[:min(toInt(stage["$limit"]), len(docs))]
+		case stage["$group"] != nil:
+			if first {
+				docs = m.matching(collName, bson.M{}, nil)
+			}
+			group := stage["$group"].(bson.M)
+			out := bson.M{"_id": group["_id"]}
+			for k, v := range group {
+				if k == "_id" {
+					continue
+				}
+				sum, ok := v.(bson.M)
+				if !ok || toInt(sum["$sum"]) != 1 {
+					panic(fakeCommandError("unsupported $group accumulator"))
+				}
+				out[k] = len(docs)
+			}
+			if len(docs) == 0 {
+				docs = nil
+			} else {
+				docs = []bson.M{out}
+			}
+		default:
+			panic(fakeCommandError(fmt.Sprintf("unsupported pipeline stage %v", stage)))
+		}
+	}
+	return cursorReply(ns, docs)
+}
+
+// normalize turns decoded BSON into plain maps and slices so documents can be
+// compared and updated uniformly.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		m := bson.M{}
+		for _, e := range v {
+			m[e.Key] = normalize(e.Value)
+		}
+		return m
+	case bson.M:
+		m := bson.M{}
+		for k, e := range v {
+			m[k] = normalize(e)
+		}
+		return m
+	case bson.A:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = normalize(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = normalize(e)
+		}
+		return out
+	}
+	return v
+}
+
+// toDOrdered keeps key order (sort and index specs depend on it).
+func toDOrdered(v interface{}) bson.D {
+	switch v := v.(type) {
+	case bson.D:
+		return v
+	case bson.M:
+		d := bson.D{}
+		for k, e := range v {
+			d = append(d, bson.E{Key: k, Value: e})
+		}
+		sort.Slice(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+		return d
+	}
+	return nil
+}
+
+func lookup(doc bson.M, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func matches(doc bson.M, filter bson.M) bool {
+	for key, cond := range filter {
+		switch key {
+		case "$or":
+			any := false
+			for _, sub := range cond.([]interface{}) {
+				if matches(doc, sub.(bson.M)) {
+					any = true
+					break
+				}
+			}
+			if !any {
+				return false
+			}
+		case "$and":
+			for _, sub := range cond.([]interface{}) {
+				if !matches(doc, sub.(bson.M)) {
+					return false
+				}
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				panic(fakeCommandError("unsupported query operator " + key))
+			}
+			value, present := lookup(doc, key)
+			if !matchValue(value, present, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchValue(value interface{}, present bool, cond interface{}) bool {
+	ops, ok := cond.(bson.M)
+	if !ok || len(ops) == 0 {
+		return equalsOrContains(value, present, cond)
+	}
+	for op := range ops {
+		if !strings.HasPrefix(op, "$") {
+			return equalsOrContains(value, present, cond)
+		}
+	}
+	for op, arg := range ops {
+		switch op {
+		case "$eq":
+			if !equalsOrContains(value, present, arg) {
+				return false
+			}
+		case "$ne":
+			if equalsOrContains(value, present, arg) {
+				return false
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !present {
+				return false
+			}
+			c, ok := compareValues(value, arg)
+			if !ok {
+				return false
+			}
+			if (op == "$gt" && c <= 0) || (op == "$gte" && c < 0) || (op == "$lt" && c >= 0) || (op == "$lte" && c > 0) {
+				return false
+			}
+		case "$in":
+			found := false
+			for _, candidate := range arg.([]interface{}) {
+				if equalsOrContains(value, present, candidate) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case "$exists":
+			if present != (arg == true) {
+				return false
+			}
+		default:
+			panic(fakeCommandError("unsupported query operator " + op))
+		}
+	}
+	return true
+}
+
+func equalsOrContains(value interface{}, present bool, want interface{}) bool {
+	if !present {
+		return want == nil
+	}
+	if arr, ok := value.([]interface{}); ok {
+		for _, elem := range arr {
+			if valuesEqual(elem, want) {
+				return true
+			}
+		}
+	}
+	return valuesEqual(value, want)
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case primitive.DateTime:
+		if b, ok := b.(primitive.DateTime); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			if a == b {
+				return 0, true
+			}
+			if !a {
+				return -1, true
+			}
+			return 1, true
+		}
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func toInt(v interface{}) int {
+	f, _ := toFloat(v)
+	return int(f)
+}
+
+func applyUpdate(doc bson.M, update bson.M) {
+	for op, arg := range update {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			panic(fakeCommandError("replacement updates are not supported"))
+		}
+		for key, value := range fields {
+			switch op {
+			case "$set":
+				doc[key] = value
+			case "$unset":
+				delete(doc, key)
+			case "$inc":
+				doc[key] = addNumbers(doc[key], value)
+			case "$push":
+				doc[key] = push(doc[key], value)
+			default:
+				panic(fakeCommandError("unsupported update operator " + op))
+			}
+		}
+	}
+}
+
+func addNumbers(a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	fa, _ := toFloat(a)
+	fb, _ := toFloat(b)
+	if aFloat || bFloat {
+		return fa + fb
+	}
+	return int64(fa + fb)
+}
+
+func push(current, value interface{}) interface{} {
+	arr, _ := current.([]interface{})
+	arr = append([]interface{}{}, arr...)
+	spec, ok := value.(bson.M)
+	if !ok || spec["$each"] == nil {
+		return append(arr, value)
+	}
+
+	each := spec["$each"].([]interface{})
+	pos := len(arr)
+	if p, ok := spec["$position"]; ok {
+		pos = min(toInt(p), len(arr))
+	}
+	arr = append(arr[:pos], append(append([]interface{}{}, each...), arr[pos:]...)...)
+	if s, ok := spec["$slice"]; ok {
+		n := toInt(s)
+		switch {
+		case n >= 0 && n < len(arr):
+			arr = arr[:n]
+		case n < 0 && -n < len(arr):
+			arr = arr[len(arr)+n:]
+		}
+	}
+	return arr
+}
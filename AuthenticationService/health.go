@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GET /health
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := client.Ping(ctx, nil); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "unhealthy", "error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "healthy",
+		"service":     "auth-service",
+		"maintenance": maintenanceMode,
+	})
+}
+
+type dependencyStatus struct {
+	Status    string `json:"status"`
+	Critical  bool   `json:"critical"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type dependencyCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// Mongo is critical: without it nothing works. The user service only backs
+// the profile created after registration, so losing it degrades the service
+// rather than taking it down.
+var dependencyChecks = []dependencyCheck{
+	{name: "mongo", critical: true, check: func(ctx context.Context) error {
+		return client.Ping(ctx, nil)
+	}},
+	{name: "user-service", critical: false, check: func(ctx context.Context) error {
+		return checkHTTPHealth(ctx, userServiceURL+"/health")
+	}},
+}
+
+func checkHTTPHealth(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// GET /health/detail
+func healthDetailHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]dependencyStatus, len(dependencyChecks))
+	for _, dep := range dependencyChecks {
+		wg.Add(1)
+		go func(dep dependencyCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := dep.check(ctx)
+			status := dependencyStatus{
+				Status:    "up",
+				Critical:  dep.critical,
+				LatencyMS: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				status.Status = "down"
+				status.Error = err.Error()
+			}
+			mu.Lock()
+			results[dep.name] = status
+			mu.Unlock()
+		}(dep)
+	}
+	wg.Wait()
+
+	overall := "healthy"
+	code := http.StatusOK
+	for _, status := range results {
+		if status.Status == "up" {
+			continue
+		}
+		if status.Critical {
+			overall = "down"
+			code = http.StatusServiceUnavailable
+			break
+		}
+		overall = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       overall,
+		"service":      "auth-service",
+		"dependencies": results,
+	})
+}
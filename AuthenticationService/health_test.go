@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type healthDetail struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+func getHealthDetail(t *testing.T, env *testEnv, wantStatus int) healthDetail {
+	t.Helper()
+	rec := env.call(http.MethodGet, "/health/detail", "", "")
+	if rec.Code != wantStatus {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, wantStatus, rec.Body.String())
+	}
+	var detail healthDetail
+	decodeJSON(t, rec, &detail)
+	return detail
+}
+
+func TestHealthDetail(t *testing.T) {
+	env := newTestEnv(t)
+
+	detail := getHealthDetail(t, env, http.StatusOK)
+	if detail.Status != "healthy" || detail.Dependencies["mongo"].Status != "up" || detail.Dependencies["user-service"].Status != "up" {
+		t.Fatalf("all up: %+v", detail)
+	}
+
+	// Losing the user service degrades the service but keeps it serving.
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	override(t, &userServiceURL, down.URL)
+	detail = getHealthDetail(t, env, http.StatusOK)
+	if detail.Status != "degraded" {
+		t.Fatalf("user service down: status %s", detail.Status)
+	}
+	if dep := detail.Dependencies["user-service"]; dep.Status != "down" || dep.Critical || dep.Error != "status 500" {
+		t.Fatalf("user service = %+v", dep)
+	}
+
+	// Losing Mongo takes it down.
+	env.mongo.setDown(true)
+	detail = getHealthDetail(t, env, http.StatusServiceUnavailable)
+	if detail.Status != "down" {
+		t.Fatalf("mongo down: status %s", detail.Status)
+	}
+	if dep := detail.Dependencies["mongo"]; dep.Status != "down" || !dep.Critical || dep.Error == "" {
+		t.Fatalf("mongo = %+v", dep)
+	}
+	if rec := env.call(http.MethodGet, "/health", "", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/health with mongo down: status %d", rec.Code)
+	}
+}
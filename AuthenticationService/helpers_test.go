@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// override sets *p to v for the rest of the test.
+func override[T any](t testing.TB, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// testClock is a settable stand-in for now.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// testEnv wires the service to an in-memory Mongo, a fixed clock and a stub
+// user service, and serves requests through the same middleware as main.
+type testEnv struct {
+	mongo    *fakeMongo
+	clock    *testClock
+	handler  http.Handler
+	profiles *profileRecorder
+	mail     *fakeEmailSender
+}
+
+func newTestEnv(t testing.TB) *testEnv {
+	t.Helper()
+
+	fm := newFakeMongo()
+	opts := options.Client()
+	opts.Deployment = fm
+	c, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("connecting to fake mongo: %v", err)
+	}
+	t.Cleanup(func() { c.Disconnect(context.Background()) })
+
+	override(t, &client, c)
+	override(t, &userCollection, nil)
+	override(t, &sessionCollection, nil)
+	override(t, &resetCollection, nil)
+	override(t, &auditCollection, nil)
+	useDatabase(c.Database("authdb"))
+	if err := ensureIndexes(context.Background()); err != nil {
+		t.Fatalf("creating indexes: %v", err)
+	}
+
+	clock := &testClock{t: time.Date(2026, 3, 2, 9, 30, 0, 0, time.UTC)}
+	override(t, &now, clock.now)
+	override(t, &verifiedTokens, newTokenCache(0, 0))
+	override(t, &maintenanceMode, false)
+	override(t, &registerLimiter, newRateLimiter(1000, time.Minute))
+	override(t, &passwordResetLimiter, newRateLimiter(1000, time.Minute))
+
+	mail := &fakeEmailSender{}
+	override[EmailSender](t, &emailSender, mail)
+
+	profiles := &profileRecorder{}
+	userService := httptest.NewServer(profiles)
+	t.Cleanup(userService.Close)
+	override(t, &userServiceURL, userService.URL)
+
+	// Registered last so it runs first: background work must finish before
+	// the globals it uses are restored.
+	t.Cleanup(background.Wait)
+
+	return &testEnv{
+		mongo:    fm,
+		clock:    clock,
+		handler:  withRecover(withMaintenance(withJSONContentType(newRouter()))),
+		profiles: profiles,
+		mail:     mail,
+	}
+}
+
+type sentEmail struct {
+	to, subject, body string
+}
+
+// fakeEmailSender records messages instead of sending them.
+type fakeEmailSender struct {
+	mu   sync.Mutex
+	sent []sentEmail
+}
+
+func (f *fakeEmailSender) Send(to, subject, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, sentEmail{to: to, subject: subject, body: body})
+	return nil
+}
+
+// messages waits for background work, which is where mail goes out, and
+// returns everything sent so far.
+func (f *fakeEmailSender) messages() []sentEmail {
+	background.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sentEmail(nil), f.sent...)
+}
+
+// profileRecorder stands in for the user service's internal profile route.
+type profileRecorder struct {
+	mu       sync.Mutex
+	profiles []map[string]interface{}
+}
+
+func (p *profileRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/profile/internal" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var profile map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&profile)
+	p.mu.Lock()
+	p.profiles = append(p.profiles, profile)
+	p.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+func jsonRequest(method, path, body, token string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func (e *testEnv) serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (e *testEnv) call(method, path, body, token string) *httptest.ResponseRecorder {
+	return e.serve(jsonRequest(method, path, body, token))
+}
+
+// addUser stores user with password hashed at the minimum bcrypt cost, which
+// keeps tests fast.
+func (e *testEnv) addUser(t testing.TB, user User, password string) {
+	t.Helper()
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Password = string(hash)
+	}
+	if _, err := userCollection.InsertOne(context.Background(), user); err != nil {
+		t.Fatalf("adding user %s: %v", user.Username, err)
+	}
+}
+
+func (e *testEnv) user(t testing.TB, username string) User {
+	t.Helper()
+	var user User
+	if err := userCollection.FindOne(context.Background(), bson.M{"username": username}).Decode(&user); err != nil {
+		t.Fatalf("loading user %s: %v", username, err)
+	}
+	return user
+}
+
+// login signs in through POST /login and returns the token.
+func (e *testEnv) login(t testing.TB, username, password string) string {
+	t.Helper()
+	rec := e.call(http.MethodPost, "/login", `{"username":"`+username+`","password":"`+password+`"}`, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login as %s: status %d: %s", username, rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, rec, &body)
+	return body.Token
+}
+
+func decodeJSON(t testing.TB, rec *httptest.ResponseRecorder, dst interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), dst); err != nil {
+		t.Fatalf("response is not JSON: %v (%q)", err, rec.Body.String())
+	}
+}
+
+// errorResponse decodes a writeError body.
+func errorResponse(t testing.TB, rec *httptest.ResponseRecorder) (code, message string) {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	decodeJSON(t, rec, &body)
+	return body.Code, body.Error
+}
+
+// expectError fails unless rec is a JSON error with the given status and code.
+func expectError(t testing.TB, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+	if got, _ := errorResponse(t, rec); got != code {
+		t.Fatalf("code = %s, want %s", got, code)
+	}
+}
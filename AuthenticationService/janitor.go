@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// expiringCollection is a collection whose records carry an expires_at field.
+// They all have TTL indexes, but Mongo's TTL monitor only runs once a minute
+// and the index may be missing on a hand-built database, so the janitor
+// deletes expired records itself as a backstop.
+type expiringCollection struct {
+	name       string
+	collection func() *mongo.Collection
+}
+
+var janitorCollections = []expiringCollection{
+	{name: "sessions", collection: func() *mongo.Collection { return sessionCollection }},
+	{name: "password resets", collection: func() *mongo.Collection { return resetCollection }},
+	{name: "login audit", collection: func() *mongo.Collection { return auditCollection }},
+}
+
+var janitorInterval = getEnvDuration("JANITOR_INTERVAL", 10*time.Minute)
+
+// runJanitor sweeps expired records every interval until ctx is cancelled.
+func runJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Janitor stopped")
+			return
+		case <-ticker.C:
+			sweepExpired(ctx)
+		}
+	}
+}
+
+func sweepExpired(parent context.Context) {
+	for _, c := range janitorCollections {
+		ctx, cancel := context.WithTimeout(parent, dbScanTimeout)
+		res, err := c.collection().DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lte": now()}})
+		cancel()
+		if err != nil {
+			log.Printf("Janitor failed to sweep %s: %v", c.name, err)
+			continue
+		}
+		if res.DeletedCount > 0 {
+			log.Printf("Janitor removed %d expired %s", res.DeletedCount, c.name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestJanitorRemovesExpiredRecords(t *testing.T) {
+	env := newTestEnv(t)
+	expired, live := now().Add(-time.Second), now().Add(time.Hour)
+
+	record := func(name string, expiresAt time.Time) bson.M {
+		// jti and token_hash satisfy the unique indexes on sessions and resets.
+		return bson.M{"name": name, "jti": name, "token_hash": name, "expires_at": expiresAt}
+	}
+	for _, c := range janitorCollections {
+		if _, err := c.collection().InsertMany(context.Background(), []interface{}{
+			record("expired", expired),
+			record("due", now()),
+			record("live", live),
+		}); err != nil {
+			t.Fatalf("seeding %s: %v", c.name, err)
+		}
+	}
+
+	sweepExpired(context.Background())
+
+	for _, name := range []string{"sessions", "password_resets", "login_audit"} {
+		docs := env.mongo.docs(name)
+		if len(docs) != 1 || docs[0]["name"] != "live" {
+			t.Errorf("%s after sweep = %v, want only the live record", name, docs)
+		}
+	}
+}
+
+func TestJanitorStopsOnShutdown(t *testing.T) {
+	env := newTestEnv(t)
+	if _, err := sessionCollection.InsertOne(context.Background(), bson.M{"jti": "old", "expires_at": now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runJanitor(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for len(env.mongo.docs("sessions")) != 0 {
+		select {
+		case <-deadline:
+			t.Fatal("janitor never swept")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("janitor kept running after its context was cancelled")
+	}
+}
+
+func TestJanitorUsesScanTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &dbScanTimeout, 42*time.Second)
+
+	var mu sync.Mutex
+	deadlines := map[string]time.Duration{}
+	env.mongo.setOnCommand(func(ctx context.Context, cmd bson.D) {
+		if cmd[0].Key != "delete" {
+			return
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Errorf("delete on %v sent without a deadline", cmd[0].Value)
+			return
+		}
+		mu.Lock()
+		deadlines[cmd[0].Value.(string)] = time.Until(deadline)
+		mu.Unlock()
+	})
+
+	sweepExpired(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deadlines) != len(janitorCollections) {
+		t.Fatalf("swept %v, want all %d collections", deadlines, len(janitorCollections))
+	}
+	for coll, left := range deadlines {
+		if left <= dbWriteTimeout || left > dbScanTimeout {
+			t.Errorf("sweep of %s had %s left, want the %s scan timeout", coll, left, dbScanTimeout)
+		}
+	}
+}
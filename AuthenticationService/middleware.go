@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"AuthenticationService/errcode"
+)
+
+type corsConfig struct {
+	allowAll         bool
+	allowedOrigins   map[string]bool
+	allowCredentials bool
+	maxAge           int
+}
+
+// loadCORSConfig reads the CORS settings from the environment. A wildcard
+// origin is only honoured behind the explicit CORS_ALLOW_ALL dev flag, and is
+// refused outright when credentials are enabled, so a production deploy can't
+// end up reflecting credentials to any site by accident.
+func loadCORSConfig() (corsConfig, error) {
+	cfg := corsConfig{
+		allowAll:         getEnv("CORS_ALLOW_ALL", "false") == "true",
+		allowedOrigins:   map[string]bool{},
+		allowCredentials: getEnv("CORS_ALLOW_CREDENTIALS", "false") == "true",
+	}
+
+	for _, origin := range strings.Split(getEnv("CORS_ALLOWED_ORIGINS", "http://localhost:5173,http://localhost:3000"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			return cfg, errors.New("CORS_ALLOWED_ORIGINS may not contain \"*\"; set CORS_ALLOW_ALL=true for development instead")
+		}
+		cfg.allowedOrigins[origin] = true
+	}
+
+	if cfg.allowAll && cfg.allowCredentials {
+		return cfg, errors.New("CORS_ALLOW_ALL cannot be combined with CORS_ALLOW_CREDENTIALS")
+	}
+
+	maxAge, err := strconv.Atoi(getEnv("CORS_MAX_AGE", "600"))
+	if err != nil || maxAge < 0 {
+		return cfg, errors.New("CORS_MAX_AGE must be a non-negative number of seconds")
+	}
+	cfg.maxAge = maxAge
+
+	return cfg, nil
+}
+
+func withCORS(cfg corsConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		switch {
+		case cfg.allowAll:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case cfg.allowedOrigins[origin]:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if cfg.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.maxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRecover turns a panicking handler into a logged 500 instead of a reset
+// connection. The request ID (taken from X-Request-ID, or generated) is logged
+// with the stack and returned to the client so the two can be matched up.
+func withRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			requestID := r.Header.Get("X-Request-ID")
+			if requestID == "" {
+				requestID, _ = newTokenID()
+			}
+			log.Printf("panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestID, rec, debug.Stack())
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Request-ID", requestID)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":      "Internal server error",
+				"code":       errcode.Internal,
+				"request_id": requestID,
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceMode is read once from MAINTENANCE_MODE at startup; turning it
+// on or off means restarting the service with the variable changed.
+var maintenanceMode = getEnv("MAINTENANCE_MODE", "false") == "true"
+
+var maintenanceRetryAfter = getEnvInt("MAINTENANCE_RETRY_AFTER", 300)
+
+// withMaintenance rejects anything that could change state with a 503 while
+// maintenance mode is on. Safe methods pass through, so health checks and
+// reads keep working during a deploy.
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maintenanceMode {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+				writeError(w, http.StatusServiceUnavailable, errcode.Maintenance, "Service under maintenance")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withJSONContentType requires mutating requests that carry a body to declare
+// it as JSON, so a form post gets a clear 415 instead of a decode error.
+func withJSONContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			if r.ContentLength == 0 {
+				break
+			}
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errcode.UnsupportedMediaType, "Content-Type must be application/json")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withoutTrailingSlash treats "/login/" as "/login" so every route answers the
+// same way with or without a trailing slash.
+func withoutTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 && strings.HasSuffix(r.URL.Path, "/") {
+			r.URL.Path = strings.TrimRight(r.URL.Path, "/")
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireServiceAuth guards routes meant only for other services. Callers
+// present the shared SERVICE_SECRET in X-Service-Key, the same header the user
+// service checks on its internal routes. User JWTs are never accepted here, and
+// neither is the default secret.
+func requireServiceAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Service-Key")
+		if key == "" || !serviceAuthConfigured() || subtle.ConstantTimeCompare([]byte(key), []byte(serviceSecret)) != 1 {
+			writeError(w, http.StatusUnauthorized, errcode.Unauthorized, "Unauthorized - Invalid service key")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"AuthenticationService/errcode"
+)
+
+func TestCORSPreflightMaxAge(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com")
+	t.Setenv("CORS_MAX_AGE", "900")
+	cfg, err := loadCORSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := withCORS(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight reached the handler")
+	}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/login", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "900" {
+		t.Fatalf("Access-Control-Max-Age = %q, want 900", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Fatalf("Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestCORSUnknownOriginGetsNoHeaders(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com")
+	cfg, err := loadCORSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := withCORS(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("Access-Control-Allow-Origin = %q, want none", got)
+	}
+}
+
+func TestCORSConfigRefusesInsecureWildcards(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"wildcard with credentials", map[string]string{"CORS_ALLOW_ALL": "true", "CORS_ALLOW_CREDENTIALS": "true"}},
+		{"star in allowed origins", map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com,*"}},
+		{"negative max age", map[string]string{"CORS_MAX_AGE": "-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if _, err := loadCORSConfig(); err == nil {
+				t.Fatal("config accepted")
+			}
+		})
+	}
+
+	t.Run("wildcard without credentials", func(t *testing.T) {
+		t.Setenv("CORS_ALLOW_ALL", "true")
+		cfg, err := loadCORSConfig()
+		if err != nil || !cfg.allowAll {
+			t.Fatalf("cfg = %+v, err = %v", cfg, err)
+		}
+	})
+}
+
+func TestWithRecoverReturnsJSON500(t *testing.T) {
+	handler := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/authinfo/alice", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	var body map[string]string
+	decodeJSON(t, rec, &body)
+	if body["code"] != errcode.Internal || body["request_id"] != "req-123" {
+		t.Fatalf("body = %v", body)
+	}
+	if got := rec.Header().Get("X-Request-ID"); got != "req-123" {
+		t.Fatalf("X-Request-ID = %q", got)
+	}
+}
+
+func TestWithRecoverGeneratesRequestID(t *testing.T) {
+	handler := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["x"]++
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/login", nil))
+
+	var body map[string]string
+	decodeJSON(t, rec, &body)
+	if rec.Code != http.StatusInternalServerError || body["request_id"] == "" {
+		t.Fatalf("status %d, body %v", rec.Code, body)
+	}
+	if rec.Header().Get("X-Request-ID") != body["request_id"] {
+		t.Fatalf("header and body request IDs differ")
+	}
+}
+
+func TestWithRecoverRepanicsAbortHandler(t *testing.T) {
+	handler := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want http.ErrAbortHandler", rec)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestMaintenanceModeBlocksWritesOnly(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+	override(t, &maintenanceMode, true)
+	override(t, &maintenanceRetryAfter, 120)
+
+	rec := env.call(http.MethodPost, "/login", `{"username":"alice","password":"password1"}`, "")
+	expectError(t, rec, http.StatusServiceUnavailable, errcode.Maintenance)
+	if got := rec.Header().Get("Retry-After"); got != "120" {
+		t.Fatalf("Retry-After = %q, want 120", got)
+	}
+	expectError(t, env.call(http.MethodPut, "/authinfo/update", `{"name":"Al"}`, token), http.StatusServiceUnavailable, errcode.Maintenance)
+
+	rec = env.call(http.MethodGet, "/health", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("health during maintenance: status %d", rec.Code)
+	}
+	var health map[string]interface{}
+	decodeJSON(t, rec, &health)
+	if health["maintenance"] != true {
+		t.Fatalf("health = %v, want maintenance true", health)
+	}
+	if rec := env.call(http.MethodGet, "/authinfo/alice", "", token); rec.Code != http.StatusOK {
+		t.Fatalf("read during maintenance: status %d", rec.Code)
+	}
+}
+
+func TestMutatingRequestsRequireJSON(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+
+	for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		req := jsonRequest(http.MethodPost, "/login", `{"username":"alice","password":"password1"}`, "")
+		req.Header.Set("Content-Type", contentType)
+		expectError(t, env.serve(req), http.StatusUnsupportedMediaType, errcode.UnsupportedMediaType)
+	}
+
+	req := jsonRequest(http.MethodPost, "/login", `{"username":"alice","password":"password1"}`, "")
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if rec := env.serve(req); rec.Code != http.StatusOK {
+		t.Fatalf("JSON with charset: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func internalUpdate(env *testEnv, key, token string) *httptest.ResponseRecorder {
+	req := jsonRequest(http.MethodPut, "/internal/authinfo/update", `{"username":"bob","name":"Robert"}`, token)
+	if key != "" {
+		req.Header.Set("X-Service-Key", key)
+	}
+	return env.serve(req)
+}
+
+func TestInternalUpdateRequiresServiceKey(t *testing.T) {
+	override(t, &serviceSecret, "internal-s3cret")
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	env.addUser(t, User{Username: "bob", Name: "Bob"}, "password2")
+	token := env.login(t, "alice", "password1")
+
+	expectError(t, internalUpdate(env, "", ""), http.StatusUnauthorized, errcode.Unauthorized)
+	expectError(t, internalUpdate(env, "wrong", ""), http.StatusUnauthorized, errcode.Unauthorized)
+	expectError(t, internalUpdate(env, "", token), http.StatusUnauthorized, errcode.Unauthorized)
+	if got := env.user(t, "bob").Name; got != "Bob" {
+		t.Fatalf("bob renamed to %q without a valid key", got)
+	}
+
+	if rec := internalUpdate(env, "internal-s3cret", ""); rec.Code != http.StatusOK {
+		t.Fatalf("valid key: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := env.user(t, "bob").Name; got != "Robert" {
+		t.Fatalf("bob name = %q", got)
+	}
+}
+
+func TestInternalRoutesOffWithoutConfiguredSecret(t *testing.T) {
+	for _, secret := range []string{"", defaultServiceSecret} {
+		override(t, &serviceSecret, secret)
+		env := newTestEnv(t)
+		env.addUser(t, User{Username: "bob", Name: "Bob"}, "password2")
+
+		if rec := internalUpdate(env, defaultServiceSecret, ""); rec.Code != http.StatusNotFound {
+			t.Fatalf("secret %q: status %d, want 404", secret, rec.Code)
+		}
+		// Even a route wrapped by mistake refuses the default key.
+		rec := httptest.NewRecorder()
+		req := jsonRequest(http.MethodPut, "/", `{}`, "")
+		req.Header.Set("X-Service-Key", defaultServiceSecret)
+		requireServiceAuth(func(w http.ResponseWriter, r *http.Request) { t.Error("handler reached") })(rec, req)
+		expectError(t, rec, http.StatusUnauthorized, errcode.Unauthorized)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"AuthenticationService/errcode"
+)
+
+// googleIdentity is what a verified Google ID token tells us about the user.
+type googleIdentity struct {
+	Subject string
+	Email   string
+	Name    string
+}
+
+// googleTokenVerifier checks a Google ID token and returns the identity in it.
+// It is an interface so the handler can run against a stub.
+type googleTokenVerifier interface {
+	Verify(ctx context.Context, idToken string) (*googleIdentity, error)
+}
+
+// tokeninfoVerifier verifies ID tokens with Google's tokeninfo endpoint, which
+// checks the signature and expiry for us; we still check the audience and
+// issuer ourselves.
+type tokeninfoVerifier struct {
+	clientID string
+	endpoint string
+	http     *http.Client
+}
+
+func (v *tokeninfoVerifier) Verify(ctx context.Context, idToken string) (*googleIdentity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.endpoint+"?id_token="+url.QueryEscape(idToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo returned status %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Aud           string `json:"aud"`
+		Iss           string `json:"iss"`
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified string `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if info.Aud != v.clientID {
+		return nil, errors.New("token was issued for another client")
+	}
+	if info.Iss != "accounts.google.com" && info.Iss != "https://accounts.google.com" {
+		return nil, errors.New("token has an unexpected issuer")
+	}
+	if info.Email == "" || info.EmailVerified != "true" {
+		return nil, errors.New("token has no verified email")
+	}
+	return &googleIdentity{Subject: info.Sub, Email: strings.ToLower(info.Email), Name: info.Name}, nil
+}
+
+// googleVerifier is nil unless GOOGLE_CLIENT_ID is set, which keeps Google
+// sign-in switched off by default.
+var googleVerifier googleTokenVerifier = newGoogleVerifier(getEnv("GOOGLE_CLIENT_ID", ""))
+
+func newGoogleVerifier(clientID string) googleTokenVerifier {
+	if clientID == "" {
+		return nil
+	}
+	return &tokeninfoVerifier{
+		clientID: clientID,
+		endpoint: "https://oauth2.googleapis.com/tokeninfo",
+		http:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+var usernameDisallowed = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// usernameFromEmail derives a candidate username from an email's local part,
+// trimmed to fit the registration username rules.
+func usernameFromEmail(email string) string {
+	local, _, _ := strings.Cut(email, "@")
+	name := strings.Trim(usernameDisallowed.ReplaceAllString(strings.ToLower(local), "_"), "_.-")
+	if len(name) > 24 {
+		name = name[:24]
+	}
+	for len(name) < 3 {
+		name += "_"
+	}
+	return name
+}
+
+// findOrCreateGoogleUser returns the user linked to identity's Google account,
+// creating a password-less one on first sign-in.
+//
+// An existing user with the same email is only linked when the email is known
+// to be theirs: it was verified, or the user has no password and so predates
+// google_sub as a Google-created user. Registration doesn't verify emails, so
+// linking on a bare match would let whoever registered an address first take
+// over its owner's Google sign-in. Otherwise the Google account gets its own
+// user, without the email, which the other user holds.
+func findOrCreateGoogleUser(ctx context.Context, identity *googleIdentity) (*User, bool, error) {
+	var user User
+	err := userCollection.FindOne(ctx, bson.M{"google_sub": identity.Subject}).Decode(&user)
+	if err == nil {
+		return &user, false, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	email := identity.Email
+	err = userCollection.FindOne(ctx, bson.M{"email": identity.Email}).Decode(&user)
+	switch {
+	case err == nil && user.GoogleSub == "" && (user.EmailVerified || user.Password == ""):
+		return linkGoogleUser(ctx, &user, identity)
+	case err == nil:
+		log.Printf("Google sign-in for %s can't be linked to user %s; creating a separate user", identity.Email, user.Username)
+		email = ""
+	case err != mongo.ErrNoDocuments:
+		return nil, false, err
+	}
+
+	base := usernameFromEmail(identity.Email)
+	for attempt := 0; attempt < 5; attempt++ {
+		username := base
+		if attempt > 0 {
+			suffix, err := newTokenID()
+			if err != nil {
+				return nil, false, err
+			}
+			username = base + "-" + suffix[:4]
+		}
+
+		count, err := userCollection.CountDocuments(ctx, bson.M{"username": username})
+		if err != nil {
+			return nil, false, err
+		}
+		if count > 0 {
+			continue
+		}
+
+		user = User{
+			Username:      username,
+			Name:          identity.Name,
+			Email:         email,
+			EmailVerified: email != "",
+			GoogleSub:     identity.Subject,
+		}
+		_, err = userCollection.InsertOne(ctx, user)
+		if duplicateKeyOn(err, "google_sub") {
+			// A concurrent first sign-in created the user; use theirs.
+			if err := userCollection.FindOne(ctx, bson.M{"google_sub": identity.Subject}).Decode(&user); err != nil {
+				return nil, false, err
+			}
+			return &user, false, nil
+		}
+		if duplicateKeyOn(err, "email") {
+			// Someone registered the address meanwhile; it isn't ours to claim.
+			email = ""
+			continue
+		}
+		if isDuplicateKey(err) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return &user, true, nil
+	}
+	return nil, false, errors.New("could not find a free username")
+}
+
+// linkGoogleUser records identity's Google account on user. The filter only
+// matches while the user is unlinked, so two Google accounts racing to link
+// the same user can't both win.
+func linkGoogleUser(ctx context.Context, user *User, identity *googleIdentity) (*User, bool, error) {
+	res, err := userCollection.UpdateOne(ctx,
+		bson.M{"username": user.Username, "google_sub": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"google_sub": identity.Subject, "email_verified": true}},
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, false, fmt.Errorf("user %s was linked to another Google account", user.Username)
+	}
+	user.GoogleSub, user.EmailVerified = identity.Subject, true
+	return user, false, nil
+}
+
+// POST /auth/oauth/google
+func googleSignInHandler(w http.ResponseWriter, r *http.Request) {
+	if googleVerifier == nil {
+		writeError(w, http.StatusNotImplemented, errcode.InvalidRequest, "Google sign-in is not configured")
+		return
+	}
+
+	var payload struct {
+		IDToken string `json:"id_token" validate:"required"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if errs := validateStruct(payload); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	ip, userAgent := clientIP(r), r.UserAgent()
+
+	identity, err := googleVerifier.Verify(ctx, payload.IDToken)
+	if err != nil {
+		log.Printf("Google ID token rejected: %v", err)
+		runInBackground(func() { recordLogin("", ip, userAgent, false, loginFailureGoogleRejected) })
+		writeError(w, http.StatusUnauthorized, errcode.InvalidCredentials, "Invalid Google ID token")
+		return
+	}
+
+	user, created, err := findOrCreateGoogleUser(ctx, identity)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+	if created {
+		runInBackground(func() { createUserProfile(user.Username, user.Name, user.Email) })
+	}
+
+	tokenString, _, err := issueToken(ctx, r, user, "", tokenTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Could not generate token")
+		return
+	}
+	runInBackground(func() { recordLogin(user.Username, ip, userAgent, true, "") })
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":    tokenString,
+		"username": user.Username,
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"AuthenticationService/errcode"
+)
+
+// stubVerifier accepts the ID tokens it was given and nothing else.
+type stubVerifier map[string]*googleIdentity
+
+func (v stubVerifier) Verify(_ context.Context, idToken string) (*googleIdentity, error) {
+	if identity, ok := v[idToken]; ok {
+		return identity, nil
+	}
+	return nil, errors.New("unknown token")
+}
+
+type googleSignIn struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+}
+
+func signInWithGoogle(t *testing.T, env *testEnv, idToken string, wantStatus int) googleSignIn {
+	t.Helper()
+	rec := env.call(http.MethodPost, "/auth/oauth/google", `{"id_token":"`+idToken+`"}`, "")
+	if rec.Code != wantStatus {
+		t.Fatalf("sign-in with %s: status %d, want %d: %s", idToken, rec.Code, wantStatus, rec.Body.String())
+	}
+	var out googleSignIn
+	decodeJSON(t, rec, &out)
+	return out
+}
+
+func TestGoogleSignInNewAndReturningUser(t *testing.T) {
+	env := newTestEnv(t)
+	override[googleTokenVerifier](t, &googleVerifier, stubVerifier{
+		"alice-token": {Subject: "g-alice", Email: "alice.smith@example.com", Name: "Alice Smith"},
+	})
+
+	first := signInWithGoogle(t, env, "alice-token", http.StatusCreated)
+	if first.Username != "alice.smith" {
+		t.Fatalf("username = %q", first.Username)
+	}
+	user := env.user(t, "alice.smith")
+	if user.GoogleSub != "g-alice" || !user.EmailVerified || user.Email != "alice.smith@example.com" || user.Password != "" {
+		t.Fatalf("created user = %+v", user)
+	}
+	if rec := env.call(http.MethodGet, "/authinfo/alice.smith", "", first.Token); rec.Code != http.StatusOK {
+		t.Fatalf("token from sign-in: status %d", rec.Code)
+	}
+
+	again := signInWithGoogle(t, env, "alice-token", http.StatusOK)
+	if again.Username != "alice.smith" || len(env.mongo.docs("users")) != 1 {
+		t.Fatalf("returning sign-in made %s (%d users)", again.Username, len(env.mongo.docs("users")))
+	}
+
+	background.Wait()
+	if len(env.profiles.profiles) != 1 {
+		t.Fatalf("created %d profiles, want 1", len(env.profiles.profiles))
+	}
+}
+
+func TestGoogleSignInDoesNotLinkUnverifiedEmail(t *testing.T) {
+	env := newTestEnv(t)
+	override[googleTokenVerifier](t, &googleVerifier, stubVerifier{
+		"victim-token": {Subject: "g-victim", Email: "victim@example.com", Name: "Victim"},
+	})
+
+	// Someone registers with the victim's address before the victim signs in.
+	rec := env.call(http.MethodPost, "/register", `{"username":"mallory","password":"password1","name":"M","email":" Victim@Example.com "}`, "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := env.user(t, "mallory").Email; got != "victim@example.com" {
+		t.Fatalf("registered email = %q, want it normalised", got)
+	}
+
+	victim := signInWithGoogle(t, env, "victim-token", http.StatusCreated)
+	if victim.Username == "mallory" {
+		t.Fatal("Google sign-in was linked to an unverified registration")
+	}
+	if user := env.user(t, victim.Username); user.GoogleSub != "g-victim" || user.Email != "" {
+		t.Fatalf("victim's user = %+v", user)
+	}
+	if user := env.user(t, "mallory"); user.GoogleSub != "" || user.EmailVerified {
+		t.Fatalf("mallory was linked: %+v", user)
+	}
+
+	// And the victim keeps landing on their own user.
+	if again := signInWithGoogle(t, env, "victim-token", http.StatusOK); again.Username != victim.Username {
+		t.Fatalf("returning sign-in = %s, want %s", again.Username, victim.Username)
+	}
+}
+
+func TestGoogleSignInLinksKnownEmail(t *testing.T) {
+	env := newTestEnv(t)
+	override[googleTokenVerifier](t, &googleVerifier, stubVerifier{
+		"verified-token": {Subject: "g-bob", Email: "bob@example.com"},
+		"legacy-token":   {Subject: "g-carol", Email: "carol@example.com"},
+		"other-token":    {Subject: "g-other", Email: "bob@example.com"},
+	})
+	env.addUser(t, User{Username: "bob", Email: "bob@example.com", EmailVerified: true}, "password1")
+	env.addUser(t, User{Username: "carol", Email: "carol@example.com"}, "")
+
+	for token, username := range map[string]string{"verified-token": "bob", "legacy-token": "carol"} {
+		got := signInWithGoogle(t, env, token, http.StatusOK)
+		if got.Username != username {
+			t.Fatalf("%s signed in as %s, want %s", token, got.Username, username)
+		}
+	}
+	if env.user(t, "bob").GoogleSub != "g-bob" || env.user(t, "carol").GoogleSub != "g-carol" {
+		t.Fatal("sign-in did not record the Google account")
+	}
+
+	// A second Google account claiming the same address can't take bob over.
+	if other := signInWithGoogle(t, env, "other-token", http.StatusCreated); other.Username == "bob" {
+		t.Fatal("a second Google account was linked to bob")
+	}
+}
+
+func TestGoogleSignInRejectsBadTokens(t *testing.T) {
+	env := newTestEnv(t)
+	override[googleTokenVerifier](t, &googleVerifier, nil)
+	expectError(t, env.call(http.MethodPost, "/auth/oauth/google", `{"id_token":"x"}`, ""), http.StatusNotImplemented, errcode.InvalidRequest)
+
+	override[googleTokenVerifier](t, &googleVerifier, stubVerifier{})
+	expectError(t, env.call(http.MethodPost, "/auth/oauth/google", `{"id_token":"forged"}`, ""), http.StatusUnauthorized, errcode.InvalidCredentials)
+}
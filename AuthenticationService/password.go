@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+
+	"AuthenticationService/errcode"
+)
+
+// passwordHistorySize is how many recent passwords, counting the current one,
+// a user may not reuse. The previous ones are kept as bcrypt hashes in
+// User.PasswordHistory, newest first.
+var passwordHistorySize = getEnvInt("PASSWORD_HISTORY", 5)
+
+// passwordReused reports whether candidate matches the current hash or any of
+// the remembered ones.
+func passwordReused(user *User, candidate string) bool {
+	hashes := append([]string{user.Password}, user.PasswordHistory...)
+	if len(hashes) > passwordHistorySize {
+		hashes = hashes[:passwordHistorySize]
+	}
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(candidate)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /auth/password
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := validateJWTFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	var payload struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required,min=6,max=72"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if errs := validateStruct(payload); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	var user User
+	if err := userCollection.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&user); err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.CurrentPassword)); err != nil {
+		writeError(w, http.StatusUnauthorized, errcode.InvalidCredentials, "Invalid password")
+		return
+	}
+
+	if passwordReused(&user, payload.NewPassword) {
+		writeError(w, http.StatusBadRequest, errcode.PasswordReused, "Password was used recently; choose a different one")
+		return
+	}
+
+	if err := replacePassword(ctx, &user, payload.NewPassword); err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Failed to update password")
+		return
+	}
+
+	log.Printf("Password changed for %s", claims.Username)
+	w.Write([]byte("Password changed; please log in again"))
+}
+
+// replacePassword stores a new password for user, moves the old hash into the
+// reuse history, and revokes every session, since a new password should
+// invalidate all existing tokens.
+func replacePassword(ctx context.Context, user *User, newPassword string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{"$set": bson.M{"password": string(hashedPassword)}}
+	if user.Password != "" {
+		update["$push"] = bson.M{"password_history": bson.M{
+			"$each":     []string{user.Password},
+			"$position": 0,
+			"$slice":    max(passwordHistorySize-1, 0),
+		}}
+	}
+	if _, err := userCollection.UpdateOne(ctx, bson.M{"username": user.Username}, update); err != nil {
+		return err
+	}
+
+	if _, err := revokeAllSessions(ctx, user.Username); err != nil {
+		log.Printf("Error revoking sessions for %s after password change: %v", user.Username, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"AuthenticationService/errcode"
+)
+
+func changePassword(env *testEnv, token, current, next string) *httptest.ResponseRecorder {
+	return env.call(http.MethodPost, "/auth/password", `{"current_password":"`+current+`","new_password":"`+next+`"}`, token)
+}
+
+func TestChangePasswordRevokesSessions(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+	other := env.login(t, "alice", "password1")
+
+	expectError(t, changePassword(env, token, "wrong", "password2"), http.StatusUnauthorized, errcode.InvalidCredentials)
+
+	if rec := changePassword(env, token, "password1", "password2"); rec.Code != http.StatusOK {
+		t.Fatalf("change: status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, old := range []string{token, other} {
+		expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", old), http.StatusUnauthorized, errcode.TokenInvalid)
+	}
+	expectError(t, env.call(http.MethodPost, "/login", `{"username":"alice","password":"password1"}`, ""), http.StatusUnauthorized, errcode.InvalidCredentials)
+	env.login(t, "alice", "password2")
+}
+
+func TestChangePasswordRejectsRecentPasswords(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &passwordHistorySize, 2)
+	env.addUser(t, User{Username: "alice"}, "password1")
+
+	token := env.login(t, "alice", "password1")
+	expectError(t, changePassword(env, token, "password1", "password1"), http.StatusBadRequest, errcode.PasswordReused)
+
+	if rec := changePassword(env, token, "password1", "password2"); rec.Code != http.StatusOK {
+		t.Fatalf("first change: status %d: %s", rec.Code, rec.Body.String())
+	}
+	token = env.login(t, "alice", "password2")
+	expectError(t, changePassword(env, token, "password2", "password1"), http.StatusBadRequest, errcode.PasswordReused)
+
+	if rec := changePassword(env, token, "password2", "password3"); rec.Code != http.StatusOK {
+		t.Fatalf("second change: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := len(env.user(t, "alice").PasswordHistory); got != 1 {
+		t.Fatalf("history holds %d hashes, want 1 (history size 2 counts the current one)", got)
+	}
+
+	// password1 has now aged out of a two-password history.
+	token = env.login(t, "alice", "password3")
+	if rec := changePassword(env, token, "password3", "password1"); rec.Code != http.StatusOK {
+		t.Fatalf("aged-out password: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
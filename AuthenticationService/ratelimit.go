@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"AuthenticationService/errcode"
+)
+
+// rateLimiter is a fixed-window counter keyed by an arbitrary string (client
+// IP, username, ...). Each handler that needs limiting owns its own instance
+// so thresholds can differ per route.
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	windows   map[string]*rateWindow
+	lastPrune time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: map[string]*rateWindow{},
+	}
+}
+
+// allow records a hit for key and reports whether it is within the limit. When
+// it isn't, the returned duration is how long until the window resets.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t := now()
+	if t.Sub(l.lastPrune) > l.window {
+		for k, w := range l.windows {
+			if t.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+		l.lastPrune = t
+	}
+
+	w, ok := l.windows[key]
+	if !ok || t.Sub(w.start) >= l.window {
+		l.windows[key] = &rateWindow{start: t, count: 1}
+		return true, 0
+	}
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(t)
+	}
+	w.count++
+	return true, 0
+}
+
+// writeRateLimited answers a request that exceeded its limit with 429 and a
+// Retry-After header rounded up to whole seconds.
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, errcode.RateLimited, "Too many requests")
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if n, err := strconv.Atoi(getEnv(key, "")); err == nil && n > 0 {
+		return n
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if d, err := time.ParseDuration(getEnv(key, "")); err == nil && d > 0 {
+		return d
+	}
+	return defaultValue
+}
+
+var registerLimiter = newRateLimiter(
+	getEnvInt("REGISTER_RATE_LIMIT", 5),
+	getEnvDuration("REGISTER_RATE_WINDOW", time.Minute),
+)
+
+var passwordResetLimiter = newRateLimiter(
+	getEnvInt("PASSWORD_RESET_RATE_LIMIT", 5),
+	getEnvDuration("PASSWORD_RESET_RATE_WINDOW", 15*time.Minute),
+)
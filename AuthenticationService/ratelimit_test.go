@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"AuthenticationService/errcode"
+)
+
+func register(env *testEnv, username, remoteAddr, forwardedFor string) int {
+	req := jsonRequest(http.MethodPost, "/register", fmt.Sprintf(`{"username":%q,"password":"password1","name":"Test"}`, username), "")
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.Header.Set("X-Real-IP", forwardedFor)
+	}
+	return env.serve(req).Code
+}
+
+func TestRegisterRateLimit(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &registerLimiter, newRateLimiter(2, time.Minute))
+
+	for i := 0; i < 2; i++ {
+		if code := register(env, fmt.Sprintf("user%d", i), "203.0.113.5:4000", ""); code != http.StatusCreated {
+			t.Fatalf("registration %d: status %d", i, code)
+		}
+	}
+
+	req := jsonRequest(http.MethodPost, "/register", `{"username":"user2","password":"password1","name":"Test"}`, "")
+	req.RemoteAddr = "203.0.113.5:4001"
+	rec := env.serve(req)
+	expectError(t, rec, http.StatusTooManyRequests, errcode.RateLimited)
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("Retry-After = %q, want 60", got)
+	}
+
+	// Another client has its own window, and the first one's resets.
+	if code := register(env, "user3", "203.0.113.6:4000", ""); code != http.StatusCreated {
+		t.Fatalf("other client: status %d", code)
+	}
+	env.clock.advance(time.Minute)
+	if code := register(env, "user4", "203.0.113.5:4000", ""); code != http.StatusCreated {
+		t.Fatalf("after the window: status %d", code)
+	}
+}
+
+func TestSpoofedForwardingHeadersDoNotBypassLimit(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &registerLimiter, newRateLimiter(1, time.Minute))
+	override(t, &trustedProxies, parseTrustedProxies("10.0.0.2"))
+
+	if code := register(env, "user0", "203.0.113.5:4000", "198.51.100.1"); code != http.StatusCreated {
+		t.Fatalf("first registration: status %d", code)
+	}
+	if code := register(env, "user1", "203.0.113.5:4000", "198.51.100.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed header from an untrusted peer: status %d, want 429", code)
+	}
+
+	// Behind the proxy, each forwarded client is limited separately.
+	if code := register(env, "user2", "10.0.0.2:5000", "198.51.100.3"); code != http.StatusCreated {
+		t.Fatalf("via proxy: status %d", code)
+	}
+	if code := register(env, "user3", "10.0.0.2:5000", "198.51.100.3"); code != http.StatusTooManyRequests {
+		t.Fatalf("same client via proxy: status %d, want 429", code)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"AuthenticationService/errcode"
+)
+
+// passwordReset is a pending reset. Only the SHA-256 of the token is stored,
+// so a database leak doesn't hand out working reset links.
+type passwordReset struct {
+	TokenHash string    `bson:"token_hash"`
+	Username  string    `bson:"username"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+var resetCollection *mongo.Collection
+
+var (
+	passwordResetTTL = getEnvDuration("PASSWORD_RESET_TTL", 30*time.Minute)
+	passwordResetURL = getEnv("PASSWORD_RESET_URL", "http://localhost:3000/reset-password")
+)
+
+func ensureResetIndexes(ctx context.Context) error {
+	_, err := resetCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	return err
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// POST /auth/forgot
+//
+// The response is identical whether or not the user exists, so this can't be
+// used to discover accounts. The lookup and email happen in the background so
+// the response time doesn't give it away either. Requests are limited per
+// client and per login, which stops one person's inbox being flooded from
+// many addresses.
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Login string `json:"login" validate:"required,max=254"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if errs := validateStruct(payload); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	login := strings.TrimSpace(payload.Login)
+	for _, key := range []string{"ip:" + clientIP(r), "login:" + strings.ToLower(login)} {
+		if ok, retryAfter := passwordResetLimiter.allow(key); !ok {
+			writeRateLimited(w, retryAfter)
+			return
+		}
+	}
+
+	runInBackground(func() { sendPasswordReset(login) })
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the account exists, a reset link has been sent"))
+}
+
+// sendPasswordReset starts a reset for the user with login as their username
+// or email, if there is one with an address to send to.
+func sendPasswordReset(login string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	var user User
+	filter := bson.M{"$or": bson.A{bson.M{"username": login}, bson.M{"email": strings.ToLower(login)}}}
+	err := userCollection.FindOne(ctx, filter).Decode(&user)
+	switch {
+	case err == mongo.ErrNoDocuments || (err == nil && user.Email == ""):
+		// Unknown user, or no address to send to.
+	case err != nil:
+		log.Printf("Error looking up %q for password reset: %v", login, err)
+	default:
+		if err := startPasswordReset(ctx, &user); err != nil {
+			log.Printf("Error starting password reset for %s: %v", user.Username, err)
+		}
+	}
+}
+
+func startPasswordReset(ctx context.Context, user *User) error {
+	token, err := newTokenID()
+	if err != nil {
+		return err
+	}
+
+	issuedAt := now()
+	_, err = resetCollection.InsertOne(ctx, passwordReset{
+		TokenHash: hashResetToken(token),
+		Username:  user.Username,
+		CreatedAt: issuedAt,
+		ExpiresAt: issuedAt.Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Use this link to reset your password. It expires in %s.\n\n%s?token=%s\n",
+		passwordResetTTL, passwordResetURL, token)
+	return emailSender.Send(user.Email, "Reset your password", body)
+}
+
+// POST /auth/reset
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token       string `json:"token" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required,min=6,max=72"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if errs := validateStruct(payload); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	var reset passwordReset
+	filter := bson.M{"token_hash": hashResetToken(payload.Token), "expires_at": bson.M{"$gt": now()}}
+	if err := resetCollection.FindOne(ctx, filter).Decode(&reset); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, http.StatusBadRequest, errcode.ResetTokenInvalid, "Reset link is invalid or has expired")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+
+	var user User
+	if err := userCollection.FindOne(ctx, bson.M{"username": reset.Username}).Decode(&user); err != nil {
+		writeError(w, http.StatusBadRequest, errcode.ResetTokenInvalid, "Reset link is invalid or has expired")
+		return
+	}
+
+	// Checked before the token is consumed, so picking a recent password
+	// doesn't burn the link.
+	if passwordReused(&user, payload.NewPassword) {
+		writeError(w, http.StatusBadRequest, errcode.PasswordReused, "Password was used recently; choose a different one")
+		return
+	}
+
+	// Deleting is what claims the token, so it stays single-use even if two
+	// requests race past the lookup above.
+	if err := resetCollection.FindOneAndDelete(ctx, filter).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, http.StatusBadRequest, errcode.ResetTokenInvalid, "Reset link is invalid or has expired")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+
+	if err := replacePassword(ctx, &user, payload.NewPassword); err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Failed to update password")
+		return
+	}
+
+	log.Printf("Password reset for %s", user.Username)
+	w.Write([]byte("Password reset; please log in again"))
+}
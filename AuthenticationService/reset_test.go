@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"AuthenticationService/errcode"
+)
+
+var resetLinkToken = regexp.MustCompile(`\?token=([0-9a-f]+)`)
+
+// requestReset calls POST /auth/forgot and returns the token from the email it
+// sent, or "" if none was sent.
+func requestReset(t *testing.T, env *testEnv, login string) string {
+	t.Helper()
+	before := len(env.mail.messages())
+	rec := env.call(http.MethodPost, "/auth/forgot", `{"login":"`+login+`"}`, "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("forgot %s: status %d: %s", login, rec.Code, rec.Body.String())
+	}
+	sent := env.mail.messages()
+	if len(sent) == before {
+		return ""
+	}
+	m := resetLinkToken.FindStringSubmatch(sent[len(sent)-1].body)
+	if m == nil {
+		t.Fatalf("no reset link in %q", sent[len(sent)-1].body)
+	}
+	return m[1]
+}
+
+func resetPassword(env *testEnv, token, password string) int {
+	return env.call(http.MethodPost, "/auth/reset", `{"token":"`+token+`","new_password":"`+password+`"}`, "").Code
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice", Email: "alice@example.com"}, "password1")
+	session := env.login(t, "alice", "password1")
+
+	token := requestReset(t, env, "Alice@Example.com")
+	if token == "" {
+		t.Fatal("no reset email sent")
+	}
+	if sent := env.mail.messages(); len(sent) != 1 || sent[0].to != "alice@example.com" {
+		t.Fatalf("sent = %+v", sent)
+	}
+
+	// Choosing a recent password is refused without using up the link.
+	rec := env.call(http.MethodPost, "/auth/reset", `{"token":"`+token+`","new_password":"password1"}`, "")
+	expectError(t, rec, http.StatusBadRequest, errcode.PasswordReused)
+
+	if code := resetPassword(env, token, "password2"); code != http.StatusOK {
+		t.Fatalf("reset: status %d", code)
+	}
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", session), http.StatusUnauthorized, errcode.TokenInvalid)
+	env.login(t, "alice", "password2")
+
+	rec = env.call(http.MethodPost, "/auth/reset", `{"token":"`+token+`","new_password":"password3"}`, "")
+	expectError(t, rec, http.StatusBadRequest, errcode.ResetTokenInvalid)
+	if len(env.mongo.docs("password_resets")) != 0 {
+		t.Fatal("used reset token was kept")
+	}
+}
+
+func TestPasswordResetTokenExpires(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice", Email: "alice@example.com"}, "password1")
+	token := requestReset(t, env, "alice")
+
+	env.clock.advance(passwordResetTTL)
+	rec := env.call(http.MethodPost, "/auth/reset", `{"token":"`+token+`","new_password":"password2"}`, "")
+	expectError(t, rec, http.StatusBadRequest, errcode.ResetTokenInvalid)
+	env.login(t, "alice", "password1")
+}
+
+func TestForgotPasswordDoesNotRevealAccounts(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice", Email: "alice@example.com"}, "password1")
+	env.addUser(t, User{Username: "noemail"}, "password1")
+
+	known := env.call(http.MethodPost, "/auth/forgot", `{"login":"alice"}`, "")
+	for _, login := range []string{"nobody", "noemail"} {
+		rec := env.call(http.MethodPost, "/auth/forgot", `{"login":"`+login+`"}`, "")
+		if rec.Code != known.Code || rec.Body.String() != known.Body.String() {
+			t.Fatalf("%s: %d %q, known user got %d %q", login, rec.Code, rec.Body.String(), known.Code, known.Body.String())
+		}
+	}
+	if sent := env.mail.messages(); len(sent) != 1 {
+		t.Fatalf("sent %d emails, want only alice's", len(sent))
+	}
+	expectError(t, env.call(http.MethodPost, "/auth/reset", `{"token":"guess","new_password":"password2"}`, ""), http.StatusBadRequest, errcode.ResetTokenInvalid)
+}
+
+func TestForgotPasswordRateLimit(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &passwordResetLimiter, newRateLimiter(2, time.Hour))
+
+	forgot := func(login, remoteAddr string) int {
+		req := jsonRequest(http.MethodPost, "/auth/forgot", `{"login":"`+login+`"}`, "")
+		req.RemoteAddr = remoteAddr
+		return env.serve(req).Code
+	}
+
+	forgot("a", "203.0.113.5:1000")
+	forgot("b", "203.0.113.5:1000")
+	if code := forgot("c", "203.0.113.5:1000"); code != http.StatusTooManyRequests {
+		t.Fatalf("third request from one client: status %d, want 429", code)
+	}
+
+	// One login from many clients is limited too, in any letter case.
+	forgot("victim@example.com", "198.51.100.1:1000")
+	forgot("Victim@Example.com", "198.51.100.2:1000")
+	if code := forgot("victim@example.com", "198.51.100.3:1000"); code != http.StatusTooManyRequests {
+		t.Fatalf("third request for one login: status %d, want 429", code)
+	}
+}
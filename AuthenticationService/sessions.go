@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"AuthenticationService/errcode"
+)
+
+// Session is the server-side record of an issued token. It lives until the
+// token expires (the TTL index on expires_at removes it) or until the user
+// revokes it, and a token whose session is gone is no longer accepted.
+type Session struct {
+	JTI       string    `bson:"jti"`
+	Username  string    `bson:"username"`
+	CreatedAt time.Time `bson:"created_at"`
+	IP        string    `bson:"ip"`
+	UserAgent string    `bson:"user_agent"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+var sessionCollection *mongo.Collection
+
+// formatTimestamp is the one time format used in JSON responses: RFC3339 in
+// UTC, so clients never have to deal with server-local offsets or the
+// nanosecond precision of time.Time's default encoding.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (s Session) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		JTI       string `json:"jti"`
+		CreatedAt string `json:"created_at"`
+		IP        string `json:"ip"`
+		UserAgent string `json:"user_agent"`
+		ExpiresAt string `json:"expires_at"`
+	}{
+		JTI:       s.JTI,
+		CreatedAt: formatTimestamp(s.CreatedAt),
+		IP:        s.IP,
+		UserAgent: s.UserAgent,
+		ExpiresAt: formatTimestamp(s.ExpiresAt),
+	})
+}
+
+func ensureSessionIndexes(ctx context.Context) error {
+	_, err := sessionCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "jti", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "username", Value: 1}},
+		},
+	})
+	return err
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// trustedProxies lists the addresses (IPs or CIDRs, comma-separated in
+// TRUSTED_PROXIES) whose X-Real-IP / X-Forwarded-For headers are believed. In
+// compose that is the nginx frontend; anyone else could set them to dodge the
+// per-IP limits.
+var trustedProxies = parseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+
+func parseTrustedProxies(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q", entry)
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q", entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the connection's remote address, unless that is a trusted proxy,
+// in which case the address the proxy reported is used instead.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	// Each proxy appends the address it saw, so the first hop from the right
+	// that isn't one of ours is the client; anything left of it is hearsay.
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hop := strings.TrimSpace(hops[i]); hop != "" && !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return host
+}
+
+func createSession(ctx context.Context, r *http.Request, jti, username string, createdAt, expiresAt time.Time) error {
+	_, err := sessionCollection.InsertOne(ctx, Session{
+		JTI:       jti,
+		Username:  username,
+		CreatedAt: createdAt,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		ExpiresAt: expiresAt,
+	})
+	return err
+}
+
+func sessionActive(ctx context.Context, jti, username string) (bool, error) {
+	count, err := sessionCollection.CountDocuments(ctx, bson.M{
+		"jti":        jti,
+		"username":   username,
+		"expires_at": bson.M{"$gt": now()},
+	})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// GET /auth/sessions
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := validateJWTFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbReadTimeout)
+	defer cancel()
+
+	filter := bson.M{"username": claims.Username, "expires_at": bson.M{"$gt": now()}}
+	cursor, err := sessionCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+	sessions := []Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":  claims.ID,
+		"sessions": sessions,
+	})
+}
+
+// DELETE /auth/sessions/{jti}
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := validateJWTFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	jti := r.PathValue("jti")
+	if jti == "" {
+		writeError(w, http.StatusBadRequest, errcode.InvalidRequest, "Session id missing")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	// Scoping the delete to the caller means another user's session id is
+	// indistinguishable from one that doesn't exist.
+	res, err := sessionCollection.DeleteOne(ctx, bson.M{"jti": jti, "username": claims.Username})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, errcode.SessionNotFound, "Session not found")
+		return
+	}
+	verifiedTokens.evictSession(jti)
+
+	log.Printf("Revoked session %s for %s", jti, claims.Username)
+	w.Write([]byte("Session revoked"))
+}
+
+// revokeAllSessions deletes every session for username, which invalidates all
+// tokens issued to them. Anything that changes a user's credentials should
+// call this so old tokens stop working.
+func revokeAllSessions(ctx context.Context, username string) (int64, error) {
+	res, err := sessionCollection.DeleteMany(ctx, bson.M{"username": username})
+	if err != nil {
+		return 0, err
+	}
+	verifiedTokens.evictUser(username)
+	return res.DeletedCount, nil
+}
+
+// POST /auth/logout-all
+func logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := validateJWTFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	revoked, err := revokeAllSessions(ctx, claims.Username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "DB error")
+		return
+	}
+
+	log.Printf("Revoked %d sessions for %s", revoked, claims.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"revoked": revoked})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"AuthenticationService/errcode"
+)
+
+type sessionList struct {
+	Current  string `json:"current"`
+	Sessions []struct {
+		JTI       string `json:"jti"`
+		UserAgent string `json:"user_agent"`
+		CreatedAt string `json:"created_at"`
+		ExpiresAt string `json:"expires_at"`
+	} `json:"sessions"`
+}
+
+func listSessions(t *testing.T, env *testEnv, token string) sessionList {
+	t.Helper()
+	rec := env.call(http.MethodGet, "/auth/sessions", "", token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list sessions: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var list sessionList
+	decodeJSON(t, rec, &list)
+	return list
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+
+	laptop := env.login(t, "alice", "password1")
+	env.clock.advance(time.Minute)
+	phone := env.login(t, "alice", "password1")
+
+	list := listSessions(t, env, laptop)
+	if len(list.Sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(list.Sessions))
+	}
+	if list.Current != list.Sessions[1].JTI {
+		t.Fatalf("current = %s, want the older session %s", list.Current, list.Sessions[1].JTI)
+	}
+	if list.Sessions[0].CreatedAt != "2026-03-02T09:31:00Z" || list.Sessions[0].ExpiresAt != "2026-03-02T10:31:00Z" {
+		t.Fatalf("session times = %s / %s", list.Sessions[0].CreatedAt, list.Sessions[0].ExpiresAt)
+	}
+	phoneJTI := list.Sessions[0].JTI
+
+	rec := env.call(http.MethodDelete, "/auth/sessions/"+phoneJTI, "", laptop)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	list = listSessions(t, env, laptop)
+	if len(list.Sessions) != 1 || list.Sessions[0].JTI != list.Current {
+		t.Fatalf("after revoke sessions = %+v", list.Sessions)
+	}
+	expectError(t, env.call(http.MethodGet, "/auth/sessions", "", phone), http.StatusUnauthorized, errcode.TokenInvalid)
+	expectError(t, env.call(http.MethodDelete, "/auth/sessions/"+phoneJTI, "", laptop), http.StatusNotFound, errcode.SessionNotFound)
+}
+
+func TestRevokeSessionOfAnotherUser(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	env.addUser(t, User{Username: "bob"}, "password2")
+	alice := env.login(t, "alice", "password1")
+	bob := env.login(t, "bob", "password2")
+	bobJTI := listSessions(t, env, bob).Current
+
+	expectError(t, env.call(http.MethodDelete, "/auth/sessions/"+bobJTI, "", alice), http.StatusNotFound, errcode.SessionNotFound)
+	if got := len(listSessions(t, env, bob).Sessions); got != 1 {
+		t.Fatalf("bob has %d sessions, want 1", got)
+	}
+}
+
+func TestLogoutAllRejectsOldTokens(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	env.addUser(t, User{Username: "bob"}, "password2")
+	first := env.login(t, "alice", "password1")
+	second := env.login(t, "alice", "password1")
+	bob := env.login(t, "bob", "password2")
+
+	rec := env.call(http.MethodPost, "/auth/logout-all", "", first)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logout-all: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var body map[string]int64
+	decodeJSON(t, rec, &body)
+	if body["revoked"] != 2 {
+		t.Fatalf("revoked = %d, want 2", body["revoked"])
+	}
+
+	for _, token := range []string{first, second} {
+		expectError(t, env.call(http.MethodGet, "/auth/sessions", "", token), http.StatusUnauthorized, errcode.TokenInvalid)
+	}
+	if got := len(listSessions(t, env, bob).Sessions); got != 1 {
+		t.Fatalf("bob has %d sessions, want 1", got)
+	}
+
+	fresh := env.login(t, "alice", "password1")
+	if got := len(listSessions(t, env, fresh).Sessions); got != 1 {
+		t.Fatalf("after logging back in alice has %d sessions, want 1", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	override(t, &trustedProxies, parseTrustedProxies("10.0.0.2, 172.28.0.0/16, not-an-ip"))
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "203.0.113.5:4000", "", "", "203.0.113.5"},
+		{"untrusted peer with headers", "203.0.113.5:4000", "198.51.100.1", "198.51.100.1", "203.0.113.5"},
+		{"trusted proxy, real ip", "10.0.0.2:5000", "198.51.100.1", "198.51.100.9", "198.51.100.1"},
+		{"trusted cidr, forwarded", "172.28.0.10:5000", "", "198.51.100.2", "198.51.100.2"},
+		{"client-prepended forwarded hop", "10.0.0.2:5000", "", "1.2.3.4, 198.51.100.3, 172.28.0.7", "198.51.100.3"},
+		{"trusted proxy, no headers", "10.0.0.2:5000", "", "", "10.0.0.2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := jsonRequest(http.MethodGet, "/", "", "")
+			req.RemoteAddr = tc.remoteAddr
+			if tc.realIP != "" {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+			if tc.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if got := clientIP(req); got != tc.want {
+				t.Fatalf("clientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
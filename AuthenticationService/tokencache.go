@@ -0,0 +1,128 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// tokenCache remembers recently verified tokens so repeat requests skip the
+// signature check and the session lookup. It is keyed by the raw token string
+// and is only as fresh as this process: revocations made here evict entries
+// immediately, while maxAge bounds how long a revocation made by another
+// instance can go unnoticed. A zero-capacity cache is disabled.
+//
+// revocations counts evictions, so a verification that read the database
+// before a revocation can't cache its token after the revocation evicted it.
+type tokenCache struct {
+	mu          sync.Mutex
+	capacity    int
+	maxAge      time.Duration
+	order       *list.List
+	entries     map[string]*list.Element
+	revocations uint64
+}
+
+type tokenCacheEntry struct {
+	token   string
+	claims  Claims
+	expires time.Time
+}
+
+func newTokenCache(capacity int, maxAge time.Duration) *tokenCache {
+	return &tokenCache{
+		capacity: capacity,
+		maxAge:   maxAge,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (c *tokenCache) get(token string) (*Claims, bool) {
+	if c.capacity <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[token]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*tokenCacheEntry)
+	if !now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, token)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	claims := entry.claims
+	return &claims, true
+}
+
+// revision returns the revocation count. Read it before checking a token
+// against the database and hand it to put.
+func (c *tokenCache) revision() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revocations
+}
+
+// put caches claims for token unless an eviction has happened since revision
+// was read, in which case the database checks may predate a revocation.
+func (c *tokenCache) put(token string, claims *Claims, revision uint64) {
+	if c.capacity <= 0 {
+		return
+	}
+	expires := now().Add(c.maxAge)
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Time.Before(expires) {
+		expires = claims.ExpiresAt.Time
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.revocations != revision {
+		return
+	}
+	if elem, ok := c.entries[token]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[token] = c.order.PushFront(&tokenCacheEntry{token: token, claims: *claims, expires: expires})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tokenCacheEntry).token)
+	}
+}
+
+// evict drops every cached token matching fn. Revocations are rare and the
+// cache is small, so a linear scan is fine.
+func (c *tokenCache) evict(fn func(*Claims) bool) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.revocations++
+	for token, elem := range c.entries {
+		if fn(&elem.Value.(*tokenCacheEntry).claims) {
+			c.order.Remove(elem)
+			delete(c.entries, token)
+		}
+	}
+}
+
+func (c *tokenCache) evictSession(jti string) {
+	c.evict(func(claims *Claims) bool { return claims.ID == jti })
+}
+
+func (c *tokenCache) evictUser(username string) {
+	c.evict(func(claims *Claims) bool { return claims.Username == username })
+}
+
+var verifiedTokens = newTokenCache(
+	getEnvInt("JWT_CACHE_SIZE", 0),
+	getEnvDuration("JWT_CACHE_MAX_AGE", 30*time.Second),
+)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"AuthenticationService/errcode"
+)
+
+func TestCachedTokenSkipsSessionLookup(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &verifiedTokens, newTokenCache(16, time.Minute))
+	env.addUser(t, User{Username: "alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+
+	if rec := env.call(http.MethodGet, "/authinfo/alice", "", token); rec.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", rec.Code)
+	}
+	// With the session gone from Mongo but not revoked through this process,
+	// the cached claims still answer until maxAge.
+	if _, err := sessionCollection.DeleteMany(context.Background(), bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWTFromRequest(jsonRequest(http.MethodGet, "/", "", token)); err != nil {
+		t.Fatalf("cached token rejected: %v", err)
+	}
+	env.clock.advance(time.Minute)
+	if _, err := validateJWTFromRequest(jsonRequest(http.MethodGet, "/", "", token)); err == nil {
+		t.Fatal("entry outlived maxAge")
+	}
+}
+
+func TestRevokedSessionIsNotServedFromCache(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &verifiedTokens, newTokenCache(16, time.Hour))
+	env.addUser(t, User{Username: "alice"}, "password1")
+	laptop := env.login(t, "alice", "password1")
+	phone := env.login(t, "alice", "password1")
+
+	phoneClaims, err := validateJWTFromRequest(jsonRequest(http.MethodGet, "/", "", phone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := verifiedTokens.get(phone); !ok {
+		t.Fatal("verified token was not cached")
+	}
+
+	rec := env.call(http.MethodDelete, "/auth/sessions/"+phoneClaims.ID, "", laptop)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d: %s", rec.Code, rec.Body.String())
+	}
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", phone), http.StatusUnauthorized, errcode.TokenInvalid)
+
+	if rec := env.call(http.MethodPost, "/auth/logout-all", "", laptop); rec.Code != http.StatusOK {
+		t.Fatalf("logout-all: status %d: %s", rec.Code, rec.Body.String())
+	}
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", laptop), http.StatusUnauthorized, errcode.TokenInvalid)
+}
+
+func TestRevocationDuringVerificationIsNotCached(t *testing.T) {
+	env := newTestEnv(t)
+	override(t, &verifiedTokens, newTokenCache(16, time.Hour))
+	env.addUser(t, User{Username: "alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+
+	// The revocation lands after the session check has passed but before the
+	// verified token would be cached.
+	env.mongo.setOnCommand(func(ctx context.Context, cmd bson.D) {
+		if cmd[0].Key == "find" && cmd[0].Value == "users" {
+			if _, err := revokeAllSessions(ctx, "alice"); err != nil {
+				t.Errorf("revoke: %v", err)
+			}
+		}
+	})
+	if _, err := validateJWTFromRequest(jsonRequest(http.MethodGet, "/", "", token)); err != nil {
+		t.Fatalf("in-flight verification: %v", err)
+	}
+	env.mongo.setOnCommand(nil)
+
+	if _, ok := verifiedTokens.get(token); ok {
+		t.Fatal("token revoked mid-verification was cached")
+	}
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", token), http.StatusUnauthorized, errcode.TokenInvalid)
+}
+
+// BenchmarkValidateJWT compares a full verification (signature, session and
+// epoch lookups) against a cache hit.
+func BenchmarkValidateJWT(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		cache *tokenCache
+	}{
+		{"uncached", newTokenCache(0, 0)},
+		{"cached", newTokenCache(1024, time.Hour)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			env := newTestEnv(b)
+			override(b, &verifiedTokens, bc.cache)
+			env.addUser(b, User{Username: "alice"}, "password1")
+			req := jsonRequest(http.MethodGet, "/", "", env.login(b, "alice", "password1"))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := validateJWTFromRequest(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
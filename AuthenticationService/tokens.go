@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+
+	"AuthenticationService/errcode"
+)
+
+// scopeTrade marks a short-lived token minted by /auth/elevate. Sensitive
+// actions (placing orders, withdrawals, and here the admin routes) require it
+// via validateScopedJWTFromRequest; ordinary login tokens carry no scope and
+// stay read-only there.
+const scopeTrade = "trade"
+
+// errTokenScope is returned for a valid token that lacks the scope a route
+// needs. writeAuthError answers it with 403 rather than 401, since logging in
+// again wouldn't help; the client has to elevate.
+var errTokenScope = errors.New("token lacks required scope")
+
+// Login tokens last TOKEN_TTL, or REMEMBER_ME_TTL when the user ticks
+// "remember me".
+var (
+	tokenTTL           = getEnvDuration("TOKEN_TTL", 1*time.Hour)
+	rememberMeTokenTTL = getEnvDuration("REMEMBER_ME_TTL", 7*24*time.Hour)
+	elevatedTokenTTL   = 5 * time.Minute
+)
+
+// Audiences: every issued token carries TOKEN_AUDIENCES (comma-separated, one
+// entry per downstream service). A service that sets EXPECTED_AUDIENCE only
+// accepts tokens naming it; when unset, the audience isn't checked.
+var (
+	tokenAudiences   = parseAudiences(getEnv("TOKEN_AUDIENCES", ""))
+	expectedAudience = getEnv("EXPECTED_AUDIENCE", "")
+)
+
+func parseAudiences(value string) jwt.ClaimStrings {
+	var audiences jwt.ClaimStrings
+	for _, aud := range strings.Split(value, ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audiences = append(audiences, aud)
+		}
+	}
+	return audiences
+}
+
+// issueToken signs a token for user and records its session, so every token
+// the service hands out can later be listed and revoked. The token carries the
+// user's current token epoch; bumping the epoch invalidates it.
+func issueToken(ctx context.Context, r *http.Request, user *User, scope string, ttl time.Duration) (string, *Claims, error) {
+	username := user.Username
+
+	jti, err := newTokenID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	issuedAt := now()
+	expirationTime := issuedAt.Add(ttl)
+	claims := &Claims{
+		Username: username,
+		Scope:    scope,
+		Epoch:    user.TokenEpoch,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   username,
+			Audience:  tokenAudiences,
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(jwtKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := createSession(ctx, r, jti, username, issuedAt, expirationTime); err != nil {
+		return "", nil, err
+	}
+
+	return tokenString, claims, nil
+}
+
+// Login response shapes. The default echoes the username next to the token;
+// "token" returns the token alone and "claims" adds its decoded claims.
+const (
+	loginShapeDefault = "default"
+	loginShapeToken   = "token"
+	loginShapeClaims  = "claims"
+)
+
+var defaultLoginShape = getEnv("LOGIN_RESPONSE_SHAPE", loginShapeDefault)
+
+// claimsResponse is the "claims" object in the claims login shape. The token
+// itself needs jwt's numeric dates, so the response copies the claims out with
+// exp and iat in the usual formatTimestamp form.
+func claimsResponse(claims *Claims) map[string]interface{} {
+	resp := map[string]interface{}{
+		"username": claims.Username,
+		"epoch":    claims.Epoch,
+		"jti":      claims.ID,
+		"sub":      claims.Subject,
+		"exp":      formatTimestamp(claims.ExpiresAt.Time),
+		"iat":      formatTimestamp(claims.IssuedAt.Time),
+	}
+	if claims.Scope != "" {
+		resp["scope"] = claims.Scope
+	}
+	if len(claims.Audience) > 0 {
+		resp["aud"] = claims.Audience
+	}
+	return resp
+}
+
+// loginResponseShape picks the shape from a "shape" parameter on the Accept
+// header (e.g. "application/json; shape=token"), falling back to
+// LOGIN_RESPONSE_SHAPE.
+func loginResponseShape(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch shape := params["shape"]; shape {
+		case loginShapeDefault, loginShapeToken, loginShapeClaims:
+			return shape
+		}
+	}
+	return defaultLoginShape
+}
+
+func hasScope(claims *Claims, scope string) bool {
+	return claims.Scope == scope
+}
+
+// POST /auth/elevate
+func elevateHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := validateJWTFromRequest(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password" validate:"required"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if errs := validateStruct(payload); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbWriteTimeout)
+	defer cancel()
+
+	var user User
+	if err := userCollection.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&user); err != nil {
+		writeError(w, http.StatusUnauthorized, errcode.TokenInvalid, "Unauthorized")
+		return
+	}
+
+	// Elevation always re-checks the password; holding a token isn't enough.
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+		writeError(w, http.StatusUnauthorized, errcode.InvalidCredentials, "Invalid password")
+		return
+	}
+
+	tokenString, elevated, err := issueToken(ctx, r, &user, scopeTrade, elevatedTokenTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errcode.Internal, "Could not generate token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":      tokenString,
+		"scope":      elevated.Scope,
+		"expires_at": formatTimestamp(elevated.ExpiresAt.Time),
+	})
+}
+
+// validateScopedJWTFromRequest is validateJWTFromRequest for routes that need
+// an elevated token.
+func validateScopedJWTFromRequest(r *http.Request, scope string) (*Claims, error) {
+	claims, err := validateJWTFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if !hasScope(claims, scope) {
+		return nil, errTokenScope
+	}
+	return claims, nil
+}
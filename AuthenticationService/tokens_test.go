@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"AuthenticationService/errcode"
+)
+
+// elevate trades token for a trade-scoped one through POST /auth/elevate.
+func (e *testEnv) elevate(t *testing.T, token, password string) string {
+	t.Helper()
+	rec := e.call(http.MethodPost, "/auth/elevate", `{"password":"`+password+`"}`, token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("elevate: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var body map[string]string
+	decodeJSON(t, rec, &body)
+	if body["scope"] != scopeTrade {
+		t.Fatalf("elevated scope = %q", body["scope"])
+	}
+	return body["token"]
+}
+
+func TestSensitiveRouteRequiresElevatedToken(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "root", Role: roleAdmin}, "adminpass")
+	env.addUser(t, User{Username: "alice"}, "password1")
+	admin := env.login(t, "root", "adminpass")
+
+	expectError(t, env.call(http.MethodPost, "/admin/users/alice/revoke-tokens", "", admin), http.StatusForbidden, errcode.InsufficientScope)
+
+	elevated := env.elevate(t, admin, "adminpass")
+	rec := env.call(http.MethodPost, "/admin/users/alice/revoke-tokens", "", elevated)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scoped token: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The elevated token is an extra session; the ordinary one keeps working
+	// for everything that doesn't need the scope.
+	if rec := env.call(http.MethodGet, "/auth/sessions", "", admin); rec.Code != http.StatusOK {
+		t.Fatalf("unscoped token on a normal route: status %d", rec.Code)
+	}
+}
+
+func TestElevateRechecksPassword(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+
+	expectError(t, env.call(http.MethodPost, "/auth/elevate", `{"password":"wrong"}`, token), http.StatusUnauthorized, errcode.InvalidCredentials)
+	expectError(t, env.call(http.MethodPost, "/auth/elevate", `{"password":"password1"}`, ""), http.StatusUnauthorized, errcode.TokenInvalid)
+}
+
+func TestElevatedNonAdminIsForbidden(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	env.addUser(t, User{Username: "bob"}, "password2")
+	elevated := env.elevate(t, env.login(t, "alice", "password1"), "password1")
+
+	expectError(t, env.call(http.MethodPost, "/admin/users/bob/revoke-tokens", "", elevated), http.StatusForbidden, errcode.Forbidden)
+}
+
+// parseClaims verifies token against the service key and returns its claims.
+func parseClaims(t testing.TB, token string) *Claims {
+	t.Helper()
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) { return jwtKey, nil }, jwt.WithTimeFunc(now)); err != nil {
+		t.Fatalf("parsing token: %v", err)
+	}
+	return claims
+}
+
+func TestRememberMeIssuesLongerToken(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	issued := now()
+
+	shortToken := env.login(t, "alice", "password1")
+	short := parseClaims(t, shortToken)
+	if got := short.ExpiresAt.Sub(issued); got != tokenTTL {
+		t.Fatalf("default token lifetime = %s, want %s", got, tokenTTL)
+	}
+
+	rec := env.call(http.MethodPost, "/login", `{"username":"alice","password":"password1","remember":true}`, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("remember login: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var body map[string]string
+	decodeJSON(t, rec, &body)
+	long := parseClaims(t, body["token"])
+	if got := long.ExpiresAt.Sub(issued); got != rememberMeTokenTTL {
+		t.Fatalf("remember-me token lifetime = %s, want %s", got, rememberMeTokenTTL)
+	}
+
+	// The session record must live as long as the token, or the token would
+	// be rejected once the session expired.
+	for _, doc := range env.mongo.docs("sessions") {
+		want := short.ExpiresAt.Time
+		if doc["jti"] == long.ID {
+			want = long.ExpiresAt.Time
+		}
+		if got := doc["expires_at"].(primitive.DateTime).Time(); !got.Equal(want) {
+			t.Errorf("session %s expires %s, want %s", doc["jti"], got, want)
+		}
+	}
+
+	env.clock.advance(2 * tokenTTL)
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", shortToken), http.StatusUnauthorized, errcode.TokenExpired)
+	if rec := env.call(http.MethodGet, "/authinfo/alice", "", body["token"]); rec.Code != http.StatusOK {
+		t.Fatalf("remember-me token after %s: status %d", 2*tokenTTL, rec.Code)
+	}
+}
+
+func TestTokenExpiresOnFakeClock(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+
+	env.clock.advance(tokenTTL - time.Second)
+	if rec := env.call(http.MethodGet, "/authinfo/alice", "", token); rec.Code != http.StatusOK {
+		t.Fatalf("a second before expiry: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	env.clock.advance(time.Second)
+	expectError(t, env.call(http.MethodGet, "/authinfo/alice", "", token), http.StatusUnauthorized, errcode.TokenExpired)
+}
+
+func loginWithAccept(t *testing.T, env *testEnv, accept string) map[string]interface{} {
+	t.Helper()
+	req := jsonRequest(http.MethodPost, "/login", `{"username":"alice","password":"password1"}`, "")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := env.serve(req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var body map[string]interface{}
+	decodeJSON(t, rec, &body)
+	if body["token"] == "" || body["token"] == nil {
+		t.Fatalf("no token in %v", body)
+	}
+	return body
+}
+
+func TestLoginResponseShapes(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+
+	if body := loginWithAccept(t, env, ""); len(body) != 2 || body["username"] != "alice" {
+		t.Fatalf("default shape = %v", body)
+	}
+	if body := loginWithAccept(t, env, "application/json; shape=token"); len(body) != 1 {
+		t.Fatalf("token shape = %v", body)
+	}
+
+	body := loginWithAccept(t, env, "text/html, application/json; shape=claims")
+	claims, ok := body["claims"].(map[string]interface{})
+	if !ok || len(body) != 2 {
+		t.Fatalf("claims shape = %v", body)
+	}
+	if claims["username"] != "alice" || claims["jti"] == "" {
+		t.Fatalf("claims = %v", claims)
+	}
+	if claims["iat"] != "2026-03-02T09:30:00Z" || claims["exp"] != "2026-03-02T10:30:00Z" {
+		t.Fatalf("claim times = %v / %v, want RFC3339 UTC", claims["iat"], claims["exp"])
+	}
+	if claims["jti"] != parseClaims(t, body["token"].(string)).ID {
+		t.Fatal("claims don't describe the returned token")
+	}
+
+	override(t, &defaultLoginShape, loginShapeToken)
+	if body := loginWithAccept(t, env, ""); len(body) != 1 {
+		t.Fatalf("configured token shape = %v", body)
+	}
+	if body := loginWithAccept(t, env, "application/json; shape=default"); body["username"] != "alice" {
+		t.Fatalf("Accept should override the configured shape: %v", body)
+	}
+}
+
+func TestExpectedAudience(t *testing.T) {
+	cases := []struct {
+		name      string
+		audiences string
+		expected  string
+		ok        bool
+	}{
+		{"matching", "auth-service, user-service", "auth-service", true},
+		{"mismatching", "user-service", "auth-service", false},
+		{"no audience on token", "", "auth-service", false},
+		{"not checked", "user-service", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			override(t, &tokenAudiences, parseAudiences(tc.audiences))
+			override(t, &expectedAudience, tc.expected)
+			env.addUser(t, User{Username: "alice"}, "password1")
+			token := env.login(t, "alice", "password1")
+
+			if got := parseClaims(t, token).Audience; len(got) != len(tokenAudiences) {
+				t.Fatalf("token audiences = %v, want %v", got, tokenAudiences)
+			}
+			rec := env.call(http.MethodGet, "/authinfo/alice", "", token)
+			if tc.ok && rec.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body.String())
+			}
+			if !tc.ok {
+				expectError(t, rec, http.StatusUnauthorized, errcode.TokenInvalid)
+			}
+		})
+	}
+}
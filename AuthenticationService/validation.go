@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+
+	"AuthenticationService/errcode"
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects every problem with a request body so clients can
+// show them all at once instead of fixing one field per round-trip.
+type validationErrors []fieldError
+
+func (v *validationErrors) add(field, message string) {
+	*v = append(*v, fieldError{Field: field, Message: message})
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs validationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Validation failed",
+		"code":   errcode.ValidationFailed,
+		"errors": errs,
+	})
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// validate checks request payloads against their `validate` struct tags. Field
+// errors are reported under the JSON name the client sent.
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	v.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+		return usernamePattern.MatchString(fl.Field().String())
+	})
+	return v
+}
+
+// validateStruct runs the tag validations on payload and translates failures
+// into field errors.
+func validateStruct(payload interface{}) validationErrors {
+	var errs validationErrors
+
+	var verrs validator.ValidationErrors
+	if err := validate.Struct(payload); !errors.As(err, &verrs) {
+		return nil
+	}
+	for _, fe := range verrs {
+		errs.add(fe.Field(), validationMessage(fe))
+	}
+	return errs
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		return fmt.Sprintf("must be at least %s characters", fe.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s characters", fe.Param())
+	case "username":
+		return "must be 3-32 characters of letters, digits, '.', '_' or '-'"
+	case "email":
+		return "must be a valid email address"
+	default:
+		return "is invalid"
+	}
+}
+
+// registerRequiredFields lists the optional registration fields that are
+// currently mandatory, from a comma-separated REGISTER_REQUIRED_FIELDS
+// (default "name"). Only "name" and "email" are recognised; username and
+// password are always required.
+var registerRequiredFields = parseRequiredFields(getEnv("REGISTER_REQUIRED_FIELDS", "name"))
+
+func parseRequiredFields(value string) map[string]bool {
+	fields := map[string]bool{}
+	for _, field := range strings.Split(value, ",") {
+		switch field = strings.TrimSpace(field); field {
+		case "name", "email":
+			fields[field] = true
+		case "":
+		default:
+			log.Printf("Ignoring unknown REGISTER_REQUIRED_FIELDS entry %q", field)
+		}
+	}
+	return fields
+}
+
+func validateRequiredFields(reg Registration) validationErrors {
+	var errs validationErrors
+	if registerRequiredFields["name"] && reg.Name == "" {
+		errs.add("name", "is required")
+	}
+	if registerRequiredFields["email"] && reg.Email == "" {
+		errs.add("email", "is required")
+	}
+	return errs
+}
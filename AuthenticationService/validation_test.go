@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"AuthenticationService/errcode"
+)
+
+// fieldErrors checks rec is a 422 validation response and returns its
+// errors as field -> message.
+func fieldErrors(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Code   string       `json:"code"`
+		Errors []fieldError `json:"errors"`
+	}
+	decodeJSON(t, rec, &body)
+	if body.Code != errcode.ValidationFailed {
+		t.Fatalf("code = %s, want %s", body.Code, errcode.ValidationFailed)
+	}
+	fields := map[string]string{}
+	for _, fe := range body.Errors {
+		fields[fe.Field] = fe.Message
+	}
+	return fields
+}
+
+func TestRegisterReportsEveryInvalidField(t *testing.T) {
+	env := newTestEnv(t)
+
+	rec := env.call(http.MethodPost, "/register", `{"username":"a!","password":"123","email":"nope"}`, "")
+	fields := fieldErrors(t, rec)
+	for _, field := range []string{"username", "password", "email", "name"} {
+		if fields[field] == "" {
+			t.Errorf("no error for %s in %v", field, fields)
+		}
+	}
+	if len(fields) != 4 {
+		t.Fatalf("errors = %v, want exactly 4", fields)
+	}
+	if len(env.mongo.docs("users")) != 0 {
+		t.Fatal("invalid registration was stored")
+	}
+}
+
+func TestUpdateUserInfoReportsFieldErrors(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice", Name: "Alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+
+	rec := env.call(http.MethodPut, "/authinfo/update", `{"name":"`+strings.Repeat("x", 101)+`"}`, token)
+	if msg := fieldErrors(t, rec)["name"]; msg != "must be at most 100 characters" {
+		t.Fatalf("name error = %q", msg)
+	}
+	if got := env.user(t, "alice").Name; got != "Alice" {
+		t.Fatalf("name changed to %q", got)
+	}
+}
+
+func TestValidateStructTags(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload interface{}
+		want    map[string]string
+	}{
+		{"valid", Registration{Username: "alice", Password: "password1", Email: "a@example.com"}, map[string]string{}},
+		{"required", Credentials{}, map[string]string{"username": "is required", "password": "is required"}},
+		{"min", Registration{Username: "alice", Password: "short"}, map[string]string{"password": "must be at least 6 characters"}},
+		{"max", Registration{Username: "alice", Password: strings.Repeat("p", 73)}, map[string]string{"password": "must be at most 72 characters"}},
+		{"username", Registration{Username: "has space", Password: "password1"}, map[string]string{"username": "must be 3-32 characters of letters, digits, '.', '_' or '-'"}},
+		{"email", Registration{Username: "alice", Password: "password1", Email: "alice"}, map[string]string{"email": "must be a valid email address"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := map[string]string{}
+			for _, fe := range validateStruct(tc.payload) {
+				got[fe.Field] = fe.Message
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("errors = %v, want %v", got, tc.want)
+			}
+			for field, msg := range tc.want {
+				if got[field] != msg {
+					t.Errorf("%s: %q, want %q", field, got[field], msg)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlersRejectTagFailures(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser(t, User{Username: "alice"}, "password1")
+	token := env.login(t, "alice", "password1")
+
+	if msg := fieldErrors(t, env.call(http.MethodPost, "/login", `{"username":"alice"}`, ""))["password"]; msg != "is required" {
+		t.Fatalf("login password error = %q", msg)
+	}
+	fields := fieldErrors(t, env.call(http.MethodPost, "/auth/password", `{"new_password":"abc"}`, token))
+	if fields["current_password"] != "is required" || fields["new_password"] != "must be at least 6 characters" {
+		t.Fatalf("password change errors = %v", fields)
+	}
+}
+
+func TestRegisterRequiredFieldsToggle(t *testing.T) {
+	env := newTestEnv(t)
+	noName := `{"username":"alice","password":"password1","email":"alice@example.com"}`
+
+	override(t, &registerRequiredFields, parseRequiredFields("name"))
+	if msg := fieldErrors(t, env.call(http.MethodPost, "/register", noName, ""))["name"]; msg != "is required" {
+		t.Fatalf("name required: error %q", msg)
+	}
+
+	override(t, &registerRequiredFields, parseRequiredFields(""))
+	if rec := env.call(http.MethodPost, "/register", noName, ""); rec.Code != http.StatusCreated {
+		t.Fatalf("name optional: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	override(t, &registerRequiredFields, parseRequiredFields(" email , bogus "))
+	fields := fieldErrors(t, env.call(http.MethodPost, "/register", `{"username":"bob","password":"password1"}`, ""))
+	if len(fields) != 1 || fields["email"] != "is required" {
+		t.Fatalf("email required: errors %v", fields)
+	}
+}
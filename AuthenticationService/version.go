@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.buildCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	buildCommit = "dev"
+	buildTime   = "unknown"
+)
+
+// GET /version
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"service":    "auth-service",
+		"commit":     buildCommit,
+		"build_time": buildTime,
+		"go_version": runtime.Version(),
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestVersionReportsBuildInfo(t *testing.T) {
+	env := newTestEnv(t)
+
+	check := func(commit, built string) {
+		t.Helper()
+		rec := env.call(http.MethodGet, "/version", "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+		var info map[string]string
+		decodeJSON(t, rec, &info)
+		want := map[string]string{
+			"service":    "auth-service",
+			"commit":     commit,
+			"build_time": built,
+			"go_version": runtime.Version(),
+		}
+		for key, value := range want {
+			if info[key] != value {
+				t.Errorf("%s = %q, want %q", key, info[key], value)
+			}
+		}
+	}
+
+	// Tests aren't built with -ldflags, so the defaults show through.
+	check("dev", "unknown")
+
+	override(t, &buildCommit, "3f2a9c1")
+	override(t, &buildTime, "2026-03-02T09:00:00Z")
+	check("3f2a9c1", "2026-03-02T09:00:00Z")
+}
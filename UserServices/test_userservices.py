@@ -0,0 +1,300 @@
+"""Tests for the user service. Run from this directory with:
+
+    python -m unittest test_userservices
+
+Mongo is replaced with in-memory collections, so no database is needed.
+"""
+import copy
+import re
+import time
+import unittest
+from datetime import datetime, timedelta, timezone
+from types import SimpleNamespace
+from unittest import mock
+
+import jwt
+
+import userservices
+from userservices import ErrorCode
+
+RFC3339_UTC = re.compile(r'^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z$')
+
+
+class FakeCollection:
+    """The subset of a pymongo collection the service uses, matching on equality"""
+
+    def __init__(self):
+        self.docs = []
+
+    def _matches(self, doc, query):
+        return all(doc.get(k) == v for k, v in query.items())
+
+    def find_one(self, query, projection=None):
+        for doc in self.docs:
+            if self._matches(doc, query):
+                found = copy.deepcopy(doc)
+                if projection:
+                    keep = [k for k, v in projection.items() if v]
+                    found = {k: found[k] for k in keep if k in found}
+                return found
+        return None
+
+    def insert_one(self, doc):
+        doc['_id'] = len(self.docs) + 1
+        self.docs.append(copy.deepcopy(doc))
+        return SimpleNamespace(inserted_id=doc['_id'])
+
+    def update_one(self, query, update, upsert=False):
+        doc = next((d for d in self.docs if self._matches(d, query)), None)
+        matched = doc is not None
+        upserted_id = None
+        if doc is None:
+            if not upsert:
+                return SimpleNamespace(matched_count=0, upserted_id=None)
+            doc = dict(query, _id=len(self.docs) + 1)
+            self.docs.append(doc)
+            upserted_id = doc['_id']
+        for field, value in update.get('$set', {}).items():
+            doc[field] = value
+        for field, value in update.get('$addToSet', {}).items():
+            values = doc.setdefault(field, [])
+            if value not in values:
+                values.append(value)
+        for field, value in update.get('$pull', {}).items():
+            doc[field] = [v for v in doc.get(field, []) if v != value]
+        return SimpleNamespace(matched_count=int(matched), upserted_id=upserted_id)
+
+
+class UserServiceTest(unittest.TestCase):
+    def setUp(self):
+        self.profiles = FakeCollection()
+        self.preferences = FakeCollection()
+        for name, value in [
+            ('profiles_collection', self.profiles),
+            ('preferences_collection', self.preferences),
+            ('lookup_limiter', userservices.RateLimiter(1000, 60)),
+        ]:
+            patcher = mock.patch.object(userservices, name, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        self.client = userservices.app.test_client()
+
+    def token(self, username, **claims):
+        claims.setdefault('exp', int(time.time()) + 3600)
+        return jwt.encode(dict(claims, username=username), userservices.JWT_SECRET, algorithm=userservices.JWT_ALGORITHM)
+
+    def auth(self, username, **claims):
+        return {'Authorization': f'Bearer {self.token(username, **claims)}'}
+
+    def add_profile(self, username, **fields):
+        self.profiles.docs.append(dict(fields, username=username))
+
+    def assertError(self, response, status, code):
+        self.assertEqual(response.status_code, status, response.get_data(as_text=True))
+        self.assertEqual(response.get_json()['code'], code)
+
+
+class CollectionNameTest(unittest.TestCase):
+    def test_env_prefix_names_collections(self):
+        with mock.patch.object(userservices, 'ENV_PREFIX', 'staging'):
+            self.assertEqual(userservices.collection_name('user_profiles'), 'staging_user_profiles')
+            self.assertEqual(userservices.collection_name('user_preferences'), 'staging_user_preferences')
+        with mock.patch.object(userservices, 'ENV_PREFIX', ''):
+            self.assertEqual(userservices.collection_name('user_profiles'), 'user_profiles')
+
+
+class TimestampTest(UserServiceTest):
+    def test_format_timestamp(self):
+        cases = {
+            datetime(2026, 10, 14, 9, 30, 0): '2026-10-14T09:30:00Z',
+            datetime(2026, 10, 14, 11, 30, 0, tzinfo=timezone(timedelta(hours=2))): '2026-10-14T09:30:00Z',
+            '2026-10-14T09:30:00.123456+00:00': '2026-10-14T09:30:00Z',
+            '2026-10-14T09:30:00Z': '2026-10-14T09:30:00Z',
+        }
+        for value, want in cases.items():
+            with self.subTest(value=value):
+                self.assertEqual(userservices.format_timestamp(value), want)
+
+    def test_responses_use_rfc3339_utc(self):
+        response = self.client.post('/profile/internal', json={'username': 'alice'},
+                                    headers={'X-Service-Key': userservices.SERVICE_SECRET})
+        self.assertEqual(response.status_code, 201)
+        self.assertRegex(response.get_json()['created_at'], RFC3339_UTC)
+
+        response = self.client.put('/profile/alice', json={'display_name': 'Alice'}, headers=self.auth('alice'))
+        self.assertEqual(response.status_code, 200)
+        profile = self.client.get('/profile/alice', headers=self.auth('alice')).get_json()
+        for field in ('created_at', 'updated_at'):
+            self.assertRegex(profile[field], RFC3339_UTC)
+
+    def test_preferences_updated_at_is_time_of_write(self):
+        written = datetime(2030, 1, 2, 3, 4, 5, tzinfo=timezone.utc)
+        with mock.patch.object(userservices, 'utc_now', return_value=written):
+            response = self.client.put('/preferences/alice', json={'default_order_qty': 5}, headers=self.auth('alice'))
+        self.assertEqual(response.status_code, 200)
+
+        preferences = self.client.get('/preferences/alice', headers=self.auth('alice')).get_json()
+        self.assertEqual(preferences['updated_at'], '2030-01-02T03:04:05Z')
+
+
+class ErrorCodeTest(UserServiceTest):
+    def test_expired_token_is_token_expired(self):
+        expired = self.auth('alice', exp=int(time.time()) - 60)
+        self.assertError(self.client.get('/profile/alice', headers=expired), 401, ErrorCode.TOKEN_EXPIRED)
+
+    def test_handlers_emit_error_codes(self):
+        self.add_profile('alice')
+        service = {'X-Service-Key': userservices.SERVICE_SECRET}
+        forged = jwt.encode({'username': 'alice', 'exp': int(time.time()) + 60}, 'wrong-secret', algorithm='HS256')
+        cases = [
+            ('missing token', 'GET', '/profile/alice', None, {}, 401, ErrorCode.TOKEN_INVALID),
+            ('forged token', 'GET', '/profile/alice', None, {'Authorization': f'Bearer {forged}'}, 401, ErrorCode.TOKEN_INVALID),
+            ('other user', 'GET', '/profile/bob', None, self.auth('alice'), 403, ErrorCode.FORBIDDEN),
+            ('no profile', 'GET', '/profile/carol', None, self.auth('carol'), 404, ErrorCode.PROFILE_NOT_FOUND),
+            ('no fields', 'PUT', '/profile/alice', {'nickname': 'x'}, self.auth('alice'), 400, ErrorCode.INVALID_REQUEST),
+            ('bad service key', 'POST', '/profile/internal', {'username': 'bob'}, {'X-Service-Key': 'nope'}, 401, ErrorCode.UNAUTHORIZED),
+            ('profile exists', 'POST', '/profile/internal', {'username': 'alice'}, service, 409, ErrorCode.PROFILE_EXISTS),
+            ('no preferences', 'DELETE', '/preferences/alice/favorites/AAPL', None, self.auth('alice'), 404, ErrorCode.PREFERENCES_NOT_FOUND),
+        ]
+        for name, method, path, body, headers, status, code in cases:
+            with self.subTest(name):
+                response = self.client.open(path, method=method, json=body, headers=headers)
+                self.assertError(response, status, code)
+
+
+class UnexpectedErrorTest(UserServiceTest):
+    def test_unhandled_exception_is_json_500(self):
+        with mock.patch.object(userservices, 'get_username_from_token', side_effect=RuntimeError('boom')):
+            response = self.client.get('/profile/alice', headers={'X-Request-ID': 'req-123'})
+        self.assertError(response, 500, ErrorCode.INTERNAL)
+        self.assertEqual(response.get_json()['request_id'], 'req-123')
+        self.assertEqual(response.headers['X-Request-ID'], 'req-123')
+        self.assertNotIn('boom', response.get_data(as_text=True))
+
+    def test_request_id_is_generated(self):
+        with mock.patch.object(userservices, 'get_username_from_token', side_effect=RuntimeError('boom')):
+            response = self.client.get('/profile/alice')
+        self.assertError(response, 500, ErrorCode.INTERNAL)
+        self.assertTrue(response.get_json()['request_id'])
+        self.assertEqual(response.headers['X-Request-ID'], response.get_json()['request_id'])
+
+    def test_http_errors_keep_their_status(self):
+        self.assertEqual(self.client.get('/no-such-route').status_code, 404)
+
+
+class AudienceTest(UserServiceTest):
+    def setUp(self):
+        super().setUp()
+        self.add_profile('alice')
+
+    def get_profile(self, **claims):
+        return self.client.get('/profile/alice', headers=self.auth('alice', **claims))
+
+    def test_expected_audience_must_match(self):
+        with mock.patch.object(userservices, 'EXPECTED_AUDIENCE', 'user-service'):
+            self.assertEqual(self.get_profile(aud=['auth-service', 'user-service']).status_code, 200)
+            self.assertEqual(self.get_profile(aud='user-service').status_code, 200)
+            self.assertError(self.get_profile(aud=['trading-service']), 401, ErrorCode.TOKEN_INVALID)
+            self.assertError(self.get_profile(), 401, ErrorCode.TOKEN_INVALID)
+
+    def test_audience_ignored_when_unset(self):
+        with mock.patch.object(userservices, 'EXPECTED_AUDIENCE', ''):
+            self.assertEqual(self.get_profile(aud=['trading-service']).status_code, 200)
+            self.assertEqual(self.get_profile().status_code, 200)
+
+
+class ProfileLookupTest(UserServiceTest):
+    def setUp(self):
+        super().setUp()
+        self.add_profile('bob', display_name='Bobby', email='bob@example.com', country='NZ')
+
+    def test_returns_only_public_fields(self):
+        response = self.client.get('/lookup/profile?username=bob', headers=self.auth('alice'))
+        self.assertEqual(response.status_code, 200, response.get_data(as_text=True))
+        self.assertEqual(response.get_json(), {'username': 'bob', 'display_name': 'Bobby'})
+
+    def test_requires_auth(self):
+        self.assertError(self.client.get('/lookup/profile?username=bob'), 401, ErrorCode.TOKEN_INVALID)
+
+    def test_unknown_user(self):
+        response = self.client.get('/lookup/profile?username=nobody', headers=self.auth('alice'))
+        self.assertError(response, 404, ErrorCode.PROFILE_NOT_FOUND)
+        self.assertError(self.client.get('/lookup/profile', headers=self.auth('alice')), 400, ErrorCode.INVALID_REQUEST)
+
+    def test_rate_limited_per_caller(self):
+        with mock.patch.object(userservices, 'lookup_limiter', userservices.RateLimiter(2, 60)):
+            for _ in range(2):
+                response = self.client.get('/lookup/profile?username=bob', headers=self.auth('alice'))
+                self.assertEqual(response.status_code, 200)
+            response = self.client.get('/lookup/profile?username=bob', headers=self.auth('alice'))
+            self.assertError(response, 429, ErrorCode.RATE_LIMITED)
+            self.assertGreater(int(response.headers['Retry-After']), 0)
+
+            # Another caller has their own budget.
+            response = self.client.get('/lookup/profile?username=bob', headers=self.auth('carol'))
+            self.assertEqual(response.status_code, 200)
+
+    def test_user_named_lookup_keeps_their_profile(self):
+        self.add_profile('lookup', display_name='Look Up', email='lookup@example.com')
+        response = self.client.get('/profile/lookup', headers=self.auth('lookup'))
+        self.assertEqual(response.status_code, 200, response.get_data(as_text=True))
+        self.assertEqual(response.get_json()['email'], 'lookup@example.com')
+
+
+class BodyLimitTest(UserServiceTest):
+    def routes(self):
+        self.add_profile('alice')
+        user = self.auth('alice')
+        return [
+            ('PUT', '/profile/alice', user),
+            ('PUT', '/preferences/alice', user),
+            ('POST', '/preferences/alice/favorites', user),
+            ('POST', '/profile/internal', {'X-Service-Key': userservices.SERVICE_SECRET}),
+        ]
+
+    def send(self, method, path, headers, body):
+        return self.client.open(path, method=method, data=body,
+                                headers=dict(headers, **{'Content-Type': 'application/json'}))
+
+    def test_rejects_bad_bodies_with_400(self):
+        bodies = {
+            'nested past the recursion limit': '[' * 5000 + ']' * 5000,
+            'nested past the depth limit': '{"display_name":' + '[' * 33 + ']' * 33 + '}',
+            'malformed': '{"display_name":',
+            'not an object': '["alice"]',
+        }
+        for method, path, headers in self.routes():
+            for name, body in bodies.items():
+                with self.subTest(route=path, body=name):
+                    self.assertError(self.send(method, path, headers, body), 400, ErrorCode.INVALID_REQUEST)
+
+    def test_rejects_oversized_bodies(self):
+        body = '{"display_name":"' + 'x' * userservices.MAX_BODY_BYTES + '"}'
+        for method, path, headers in self.routes():
+            with self.subTest(route=path):
+                self.assertError(self.send(method, path, headers, body), 413, ErrorCode.INVALID_REQUEST)
+
+
+class StringFieldTest(UserServiceTest):
+    def test_rejects_operator_objects_in_string_fields(self):
+        self.add_profile('alice')
+        service = {'X-Service-Key': userservices.SERVICE_SECRET}
+        cases = [
+            ('POST', '/profile/internal', {'username': {'$ne': ''}}, service, 'username'),
+            ('POST', '/profile/internal', {'username': 'bob', 'email': {'$gt': ''}}, service, 'email'),
+            ('PUT', '/profile/alice', {'display_name': {'$set': 'x'}}, self.auth('alice'), 'display_name'),
+            ('POST', '/preferences/alice/favorites', {'symbol': {'$ne': ''}}, self.auth('alice'), 'symbol'),
+            ('POST', '/preferences/alice/favorites', {'symbol': 42}, self.auth('alice'), 'symbol'),
+        ]
+        for method, path, body, headers, field in cases:
+            with self.subTest(path=path, body=body):
+                response = self.client.open(path, method=method, json=body, headers=headers)
+                self.assertError(response, 400, ErrorCode.INVALID_REQUEST)
+                self.assertIn(f'field {field} must be a string', response.get_json()['error'])
+
+        self.assertEqual([p['username'] for p in self.profiles.docs], ['alice'])
+        self.assertEqual(self.preferences.docs, [])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -3,37 +3,61 @@ from flask_cors import CORS
 from pymongo import MongoClient
 from bson import ObjectId
 from datetime import datetime, timezone
+import json
 import os
+import platform
 import logging
+import threading
+import time
 import jwt
+import uuid
 from functools import wraps
-from typing import Dict, Any, Optional
+from werkzeug.exceptions import HTTPException, RequestEntityTooLarge
+from typing import Dict, Any, Optional, Tuple
 
 # Configure logging
 logging.basicConfig(level=logging.INFO)
 logger = logging.getLogger(__name__)
 
-now_utc = datetime.now(timezone.utc).isoformat()
+# Request bodies here are small profile and preference payloads, so these are
+# far above anything a legitimate client sends. Same limits as the auth service.
+MAX_BODY_BYTES = 64 * 1024
+MAX_JSON_DEPTH = 32
 
 app = Flask(__name__)
+app.config['MAX_CONTENT_LENGTH'] = MAX_BODY_BYTES
 CORS(app)
 
 # MongoDB connection
 MONGO_URI = os.getenv('MONGO_URI', 'mongodb://mongodb:27017')
 DB_NAME = os.getenv('DB_NAME', 'userdb')
 
+# Lets several environments share one Mongo instance, e.g. ENV_PREFIX=staging
+# uses staging_user_profiles. Matches the auth service's ENV_PREFIX.
+ENV_PREFIX = os.getenv('ENV_PREFIX', '')
+
+
+def collection_name(name: str) -> str:
+    """Return the collection name for the current environment"""
+    return f"{ENV_PREFIX}_{name}" if ENV_PREFIX else name
+
 # JWT Configuration - should match auth service secret
 JWT_SECRET = os.getenv('JWT_SECRET', 'supersecretkey')
 JWT_ALGORITHM = 'HS256'
 
+# When set, only tokens whose aud claim names this service are accepted (the
+# auth service lists audiences in TOKEN_AUDIENCES). When unset, aud is ignored,
+# so tokens minted with audiences for other services still work here.
+EXPECTED_AUDIENCE = os.getenv('EXPECTED_AUDIENCE', '')
+
 # Service-to-service authentication
 SERVICE_SECRET = os.getenv('SERVICE_SECRET', 'service-secret-key')
 
 try:
     client = MongoClient(MONGO_URI, serverSelectionTimeoutMS=5000)
     db = client[DB_NAME]
-    profiles_collection = db['user_profiles']
-    preferences_collection = db['user_preferences']
+    profiles_collection = db[collection_name('user_profiles')]
+    preferences_collection = db[collection_name('user_preferences')]
     # Test connection
     client.admin.command('ping')
     logger.info("Connected to MongoDB successfully")
@@ -41,23 +65,78 @@ except Exception as e:
     logger.error(f"MongoDB connection error: {e}")
 
 
+class ErrorCode:
+    """Machine-readable codes carried in the "code" field of every JSON error.
+
+    These are the same strings the auth service returns (see
+    AuthenticationService/errcode), so clients can branch on one list; a code
+    added to either service belongs in both.
+    """
+    INVALID_REQUEST = "INVALID_REQUEST"
+    UNAUTHORIZED = "UNAUTHORIZED"
+    FORBIDDEN = "FORBIDDEN"
+    RATE_LIMITED = "RATE_LIMITED"
+    INTERNAL = "INTERNAL_ERROR"
+    TOKEN_EXPIRED = "TOKEN_EXPIRED"
+    TOKEN_INVALID = "TOKEN_INVALID"
+    PROFILE_NOT_FOUND = "PROFILE_NOT_FOUND"
+    PROFILE_EXISTS = "PROFILE_EXISTS"
+    PREFERENCES_NOT_FOUND = "PREFERENCES_NOT_FOUND"
+
+
+def format_timestamp(value) -> str:
+    """Format a stored time as RFC3339 UTC with a Z suffix, like the auth service
+
+    Accepts datetimes (naive ones are UTC, which is how pymongo returns them)
+    and the ISO strings older records were written with.
+    """
+    if isinstance(value, str):
+        try:
+            value = datetime.fromisoformat(value)
+        except ValueError:
+            return value
+    if value.tzinfo is None:
+        value = value.replace(tzinfo=timezone.utc)
+    return value.astimezone(timezone.utc).strftime('%Y-%m-%dT%H:%M:%SZ')
+
+
+def utc_now() -> datetime:
+    """Current time to store on a write"""
+    return datetime.now(timezone.utc)
+
+
+def with_timestamps(doc: Dict[str, Any]) -> Dict[str, Any]:
+    """Format the created_at/updated_at fields of a document for a JSON response"""
+    for field in ('created_at', 'updated_at'):
+        if doc.get(field) is not None:
+            doc[field] = format_timestamp(doc[field])
+    return doc
+
+
 def json_serial(obj):
     """JSON serializer for objects not serializable by default json code"""
-    if isinstance(obj, (datetime, ObjectId)):
+    if isinstance(obj, datetime):
+        return format_timestamp(obj)
+    if isinstance(obj, ObjectId):
         return str(obj)
     raise TypeError(f"Type {type(obj)} not serializable")
 
 
-def get_username_from_token() -> Optional[str]:
-    """Extract and validate username from Authorization header (JWT token)"""
+def get_username_from_token() -> Tuple[Optional[str], Optional[str]]:
+    """Extract and validate username from Authorization header (JWT token)
+
+    Returns (username, None) for a valid token, or (None, error code) saying
+    why it was rejected. Expired tokens get TOKEN_EXPIRED, like the auth
+    service, so clients know to refresh rather than sign in again.
+    """
     auth_header = request.headers.get('Authorization')
     if not auth_header:
-        return None
+        return None, ErrorCode.TOKEN_INVALID
     
     # Extract token from "Bearer <token>" format
     parts = auth_header.split()
     if len(parts) != 2 or parts[0].lower() != 'bearer':
-        return None
+        return None, ErrorCode.TOKEN_INVALID
     
     token = parts[1]
     
@@ -67,21 +146,94 @@ def get_username_from_token() -> Optional[str]:
             token,
             JWT_SECRET,
             algorithms=[JWT_ALGORITHM],
-            options={"verify_signature": True, "verify_exp": True}
+            audience=EXPECTED_AUDIENCE or None,
+            options={
+                "verify_signature": True,
+                "verify_exp": True,
+                "verify_aud": bool(EXPECTED_AUDIENCE)
+            }
         )
         
         # Extract username from token (can be in 'username' or 'sub' field)
         username = decoded_token.get('username') or decoded_token.get('sub')
-        return username
+        if not username:
+            return None, ErrorCode.TOKEN_INVALID
+        return username, None
     except jwt.ExpiredSignatureError:
         logger.warning("JWT token has expired")
-        return None
+        return None, ErrorCode.TOKEN_EXPIRED
     except jwt.InvalidTokenError as e:
         logger.warning(f"Invalid JWT token: {e}")
-        return None
+        return None, ErrorCode.TOKEN_INVALID
     except Exception as e:
         logger.error(f"Error decoding JWT token: {e}")
-        return None
+        return None, ErrorCode.TOKEN_INVALID
+
+
+def json_too_deep(body: bytes, limit: int) -> bool:
+    """Whether objects/arrays in raw JSON nest beyond limit
+
+    Only brackets outside strings count; validity is left to the parser. This
+    runs before parsing because json.loads raises RecursionError on deep input.
+    """
+    depth = 0
+    in_string = escaped = False
+    for c in body.decode('utf-8', errors='replace'):
+        if in_string:
+            if escaped:
+                escaped = False
+            elif c == '\\':
+                escaped = True
+            elif c == '"':
+                in_string = False
+            continue
+        if c == '"':
+            in_string = True
+        elif c in '{[':
+            depth += 1
+            if depth > limit:
+                return True
+        elif c in '}]':
+            depth -= 1
+    return False
+
+
+def decode_json_body():
+    """Parse the request body as JSON within MAX_BODY_BYTES and MAX_JSON_DEPTH
+
+    Returns (data, None), with data None for an empty body, or (None, error
+    response) for a body that is too large, too deeply nested, malformed or
+    not an object.
+    """
+    try:
+        body = request.get_data(cache=True)
+    except RequestEntityTooLarge:
+        return None, (jsonify({"error": "Request body too large", "code": ErrorCode.INVALID_REQUEST}), 413)
+
+    if not body.strip():
+        return None, None
+    if json_too_deep(body, MAX_JSON_DEPTH):
+        return None, (jsonify({"error": "Invalid request: JSON nested too deeply", "code": ErrorCode.INVALID_REQUEST}), 400)
+    try:
+        data = json.loads(body)
+    except (ValueError, RecursionError):
+        return None, (jsonify({"error": "Malformed JSON", "code": ErrorCode.INVALID_REQUEST}), 400)
+    if not isinstance(data, dict):
+        return None, (jsonify({"error": "Invalid request: body must be a JSON object", "code": ErrorCode.INVALID_REQUEST}), 400)
+    return data, None
+
+
+def non_string_field(data: Dict[str, Any], fields) -> Optional[tuple]:
+    """A 400 response for the first of fields in data whose value isn't a string
+
+    Body values end up in Mongo queries and updates, so an object where a
+    string belongs (e.g. {"username": {"$ne": ""}}) must never get through.
+    Returns None when every present field is a string.
+    """
+    for field in fields:
+        if field in data and not isinstance(data[field], str):
+            return jsonify({"error": f"Invalid request: field {field} must be a string", "code": ErrorCode.INVALID_REQUEST}), 400
+    return None
 
 
 def require_service_auth(f):
@@ -91,7 +243,7 @@ def require_service_auth(f):
         service_key = request.headers.get('X-Service-Key')
         
         if not service_key or service_key != SERVICE_SECRET:
-            return jsonify({"error": "Unauthorized - Invalid service key"}), 401
+            return jsonify({"error": "Unauthorized - Invalid service key", "code": ErrorCode.UNAUTHORIZED}), 401
         
         return f(*args, **kwargs)
     
@@ -102,17 +254,19 @@ def require_auth(f):
     """Decorator to require JWT authentication"""
     @wraps(f)
     def decorated_function(*args, **kwargs):
-        username_from_token = get_username_from_token()
+        username_from_token, error_code = get_username_from_token()
         
+        if error_code == ErrorCode.TOKEN_EXPIRED:
+            return jsonify({"error": "Unauthorized - Token expired", "code": error_code}), 401
         if not username_from_token:
-            return jsonify({"error": "Unauthorized - Invalid or missing token"}), 401
+            return jsonify({"error": "Unauthorized - Invalid or missing token", "code": ErrorCode.TOKEN_INVALID}), 401
         
         # Get username from route parameter if it exists
         route_username = kwargs.get('username')
         
         # If route has username parameter, verify it matches token
         if route_username and username_from_token != route_username:
-            return jsonify({"error": "Forbidden - Cannot access other user's data"}), 403
+            return jsonify({"error": "Forbidden - Cannot access other user's data", "code": ErrorCode.FORBIDDEN}), 403
         
         # Add username to kwargs for use in the route
         kwargs['authenticated_username'] = username_from_token
@@ -121,6 +275,23 @@ def require_auth(f):
     return decorated_function
 
 
+@app.errorhandler(Exception)
+def handle_unexpected_error(e):
+    """Turn an exception no route handled into a JSON 500 tagged with the request ID"""
+    if isinstance(e, HTTPException):
+        return e
+
+    request_id = request.headers.get('X-Request-ID') or uuid.uuid4().hex
+    logger.exception(f"Unhandled error serving {request.method} {request.path} (request {request_id})")
+    response = jsonify({
+        "error": "Internal server error",
+        "code": ErrorCode.INTERNAL,
+        "request_id": request_id
+    })
+    response.headers['X-Request-ID'] = request_id
+    return response, 500
+
+
 @app.route('/health', methods=['GET'])
 def health_check():
     """Health check endpoint"""
@@ -131,6 +302,82 @@ def health_check():
         return jsonify({"status": "unhealthy", "error": str(e)}), 503
 
 
+@app.route('/version', methods=['GET'])
+def version():
+    """Build info injected at image build time"""
+    return jsonify({
+        "service": "user-service",
+        "commit": os.getenv('GIT_COMMIT', 'dev'),
+        "build_time": os.getenv('BUILD_TIME', 'unknown'),
+        "python_version": platform.python_version()
+    }), 200
+
+
+class RateLimiter:
+    """Fixed-window counter keyed by an arbitrary string, like the auth service's"""
+
+    def __init__(self, limit: int, window: int):
+        self.limit = limit
+        self.window = window
+        self.lock = threading.Lock()
+        self.windows: Dict[str, list] = {}
+
+    def allow(self, key: str):
+        """Record a hit for key; return (allowed, seconds until the window resets)"""
+        now = time.monotonic()
+        with self.lock:
+            for k in [k for k, (start, _) in self.windows.items() if now - start >= self.window]:
+                del self.windows[k]
+            start, count = self.windows.get(key, (now, 0))
+            if count >= self.limit:
+                return False, int(start + self.window - now) + 1
+            self.windows[key] = (start, count + 1)
+            return True, 0
+
+
+# Lookups let any signed-in user test whether a username exists, so each caller
+# gets a small budget to keep that from turning into enumeration.
+lookup_limiter = RateLimiter(
+    int(os.getenv('LOOKUP_RATE_LIMIT', 30)),
+    int(os.getenv('LOOKUP_RATE_WINDOW', 60))
+)
+
+
+@app.route('/lookup/profile', methods=['GET'])
+@require_auth
+def lookup_user_profile(authenticated_username: str):
+    """Public display name for another user, e.g. to confirm a transfer recipient
+
+    Returns only username and display_name. It lives outside /profile/ so it
+    can't shadow the profile of a user named "lookup".
+    """
+    allowed, retry_after = lookup_limiter.allow(authenticated_username)
+    if not allowed:
+        response = jsonify({"error": "Too many requests", "code": ErrorCode.RATE_LIMITED})
+        response.headers['Retry-After'] = str(retry_after)
+        return response, 429
+
+    username = request.args.get('username', '').strip()
+    if not username:
+        return jsonify({"error": "Username is required", "code": ErrorCode.INVALID_REQUEST}), 400
+
+    try:
+        profile = profiles_collection.find_one(
+            {"username": username},
+            {"_id": 0, "username": 1, "display_name": 1}
+        )
+        if not profile:
+            return jsonify({"error": "User profile not found", "code": ErrorCode.PROFILE_NOT_FOUND}), 404
+
+        return jsonify({
+            "username": profile["username"],
+            "display_name": profile.get("display_name") or profile["username"]
+        }), 200
+    except Exception as e:
+        logger.error(f"Error looking up user profile: {e}")
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
+
+
 @app.route('/profile/<username>', methods=['GET'])
 @require_auth
 def get_user_profile(username: str, authenticated_username: str):
@@ -139,17 +386,14 @@ def get_user_profile(username: str, authenticated_username: str):
         profile = profiles_collection.find_one({"username": username})
         
         if not profile:
-            return jsonify({"error": "User profile not found"}), 404
+            return jsonify({"error": "User profile not found", "code": ErrorCode.PROFILE_NOT_FOUND}), 404
         
         # Remove MongoDB _id and convert to JSON-serializable format
         profile.pop('_id', None)
-        if 'created_at' in profile:
-            profile['created_at'] = str(profile['created_at'])
-        
-        return jsonify(profile), 200
+        return jsonify(with_timestamps(profile)), 200
     except Exception as e:
         logger.error(f"Error fetching user profile: {e}")
-        return jsonify({"error": "Internal server error"}), 500
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
 
 
 @app.route('/profile/<username>', methods=['PUT'])
@@ -157,20 +401,25 @@ def get_user_profile(username: str, authenticated_username: str):
 def update_user_profile(username: str, authenticated_username: str):
     """Update user profile data"""
     try:
-        data = request.get_json()
+        data, error = decode_json_body()
+        if error:
+            return error
         
         if not data:
-            return jsonify({"error": "No data provided"}), 400
+            return jsonify({"error": "No data provided", "code": ErrorCode.INVALID_REQUEST}), 400
         
         # Allowed fields for profile update
         allowed_fields = ['display_name', 'email', 'timezone', 'country']
+        error = non_string_field(data, allowed_fields)
+        if error:
+            return error
         update_data = {k: v for k, v in data.items() if k in allowed_fields}
         
         if not update_data:
-            return jsonify({"error": "No valid fields to update"}), 400
+            return jsonify({"error": "No valid fields to update", "code": ErrorCode.INVALID_REQUEST}), 400
         
         # Add updated timestamp
-        update_data['updated_at'] = datetime.utcnow()
+        update_data['updated_at'] = utc_now()
         
         result = profiles_collection.update_one(
             {"username": username},
@@ -179,12 +428,12 @@ def update_user_profile(username: str, authenticated_username: str):
         )
         
         if result.matched_count == 0:
-            return jsonify({"error": "User profile not found"}), 404
+            return jsonify({"error": "User profile not found", "code": ErrorCode.PROFILE_NOT_FOUND}), 404
         
         return jsonify({"message": "Profile updated successfully"}), 200
     except Exception as e:
         logger.error(f"Error updating user profile: {e}")
-        return jsonify({"error": "Internal server error"}), 500
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
 
 
 @app.route('/profile/internal', methods=['POST'])
@@ -192,36 +441,42 @@ def update_user_profile(username: str, authenticated_username: str):
 def create_user_profile_internal():
     """Internal endpoint for service-to-service calls (e.g., from auth service during registration)"""
     try:
-        data = request.get_json()
+        data, error = decode_json_body()
+        if error:
+            return error
         
         if not data or 'username' not in data:
-            return jsonify({"error": "Username is required"}), 400
+            return jsonify({"error": "Username is required", "code": ErrorCode.INVALID_REQUEST}), 400
+        error = non_string_field(data, ['username', 'display_name', 'email', 'timezone', 'country'])
+        if error:
+            return error
         
         username = data['username']
         
         # Check if profile already exists
         existing = profiles_collection.find_one({"username": username})
         if existing:
-            return jsonify({"error": "User profile already exists"}), 409
+            return jsonify({"error": "User profile already exists", "code": ErrorCode.PROFILE_EXISTS}), 409
         
         # Create new profile
+        now = utc_now()
         profile = {
             "username": username,
             "display_name": data.get('display_name', username),
             "email": data.get('email', ''),
             "timezone": data.get('timezone', 'UTC'),
             "country": data.get('country', ''),
-            "created_at": datetime.now(timezone.utc).isoformat(),
-            "updated_at": datetime.now(timezone.utc).isoformat()
+            "created_at": now,
+            "updated_at": now
         }
         
         profiles_collection.insert_one(profile)
         profile.pop('_id', None)
         
-        return jsonify(profile), 201
+        return jsonify(with_timestamps(profile)), 201
     except Exception as e:
         logger.error(f"Error creating user profile: {e}")
-        return jsonify({"error": "Internal server error"}), 500
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
 
 
 @app.route('/preferences/<username>', methods=['GET'])
@@ -251,13 +506,10 @@ def get_user_preferences(username: str, authenticated_username: str):
         
         # Remove MongoDB _id
         preferences.pop('_id', None)
-        if 'updated_at' in preferences:
-            preferences['updated_at'] = str(preferences['updated_at'])
-        
-        return jsonify(preferences), 200
+        return jsonify(with_timestamps(preferences)), 200
     except Exception as e:
         logger.error(f"Error fetching user preferences: {e}")
-        return jsonify({"error": "Internal server error"}), 500
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
 
 
 @app.route('/preferences/<username>', methods=['PUT'])
@@ -265,10 +517,12 @@ def get_user_preferences(username: str, authenticated_username: str):
 def update_user_preferences(username: str, authenticated_username: str):
     """Update user preferences"""
     try:
-        data = request.get_json()
+        data, error = decode_json_body()
+        if error:
+            return error
         
         if not data:
-            return jsonify({"error": "No data provided"}), 400
+            return jsonify({"error": "No data provided", "code": ErrorCode.INVALID_REQUEST}), 400
         
         # Define allowed fields and their types
         allowed_fields = {
@@ -286,13 +540,13 @@ def update_user_preferences(username: str, authenticated_username: str):
                 if isinstance(data[field], field_type):
                     update_data[field] = data[field]
                 else:
-                    return jsonify({"error": f"Invalid type for {field}"}), 400
+                    return jsonify({"error": f"Invalid type for {field}", "code": ErrorCode.INVALID_REQUEST}), 400
         
         if not update_data:
-            return jsonify({"error": "No valid fields to update"}), 400
+            return jsonify({"error": "No valid fields to update", "code": ErrorCode.INVALID_REQUEST}), 400
         
         # Add updated timestamp
-        update_data['updated_at'] = now_utc
+        update_data['updated_at'] = utc_now()
         
         # Upsert: create if doesn't exist, update if it does
         result = preferences_collection.update_one(
@@ -311,7 +565,7 @@ def update_user_preferences(username: str, authenticated_username: str):
         return jsonify({"message": "Preferences updated successfully"}), 200
     except Exception as e:
         logger.error(f"Error updating user preferences: {e}")
-        return jsonify({"error": "Internal server error"}), 500
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
 
 
 @app.route('/preferences/<username>/favorites', methods=['POST'])
@@ -319,10 +573,15 @@ def update_user_preferences(username: str, authenticated_username: str):
 def add_favorite_symbol(username: str, authenticated_username: str):
     """Add a symbol to user's favorites"""
     try:
-        data = request.get_json()
+        data, error = decode_json_body()
+        if error:
+            return error
         
         if not data or 'symbol' not in data:
-            return jsonify({"error": "Symbol is required"}), 400
+            return jsonify({"error": "Symbol is required", "code": ErrorCode.INVALID_REQUEST}), 400
+        error = non_string_field(data, ['symbol'])
+        if error:
+            return error
         
         symbol = data['symbol'].upper()
         
@@ -330,7 +589,7 @@ def add_favorite_symbol(username: str, authenticated_username: str):
             {"username": username},
             {
                 "$addToSet": {"favorite_symbols": symbol},
-                "$set": {"updated_at": now_utc}
+                "$set": {"updated_at": utc_now()}
             },
             upsert=True
         )
@@ -343,7 +602,7 @@ def add_favorite_symbol(username: str, authenticated_username: str):
                     "$set": {
                         "username": username,
                         "favorite_symbols": [symbol],
-                        "updated_at": now_utc
+                        "updated_at": utc_now()
                     }
                 },
                 upsert=True
@@ -352,7 +611,7 @@ def add_favorite_symbol(username: str, authenticated_username: str):
         return jsonify({"message": f"Symbol {symbol} added to favorites"}), 200
     except Exception as e:
         logger.error(f"Error adding favorite symbol: {e}")
-        return jsonify({"error": "Internal server error"}), 500
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
 
 
 @app.route('/preferences/<username>/favorites/<symbol>', methods=['DELETE'])
@@ -366,17 +625,17 @@ def remove_favorite_symbol(username: str, symbol: str, authenticated_username: s
             {"username": username},
             {
                 "$pull": {"favorite_symbols": symbol},
-                "$set": {"updated_at": now_utc}
+                "$set": {"updated_at": utc_now()}
             }
         )
         
         if result.matched_count == 0:
-            return jsonify({"error": "User preferences not found"}), 404
+            return jsonify({"error": "User preferences not found", "code": ErrorCode.PREFERENCES_NOT_FOUND}), 404
         
         return jsonify({"message": f"Symbol {symbol} removed from favorites"}), 200
     except Exception as e:
         logger.error(f"Error removing favorite symbol: {e}")
-        return jsonify({"error": "Internal server error"}), 500
+        return jsonify({"error": "Internal server error", "code": ErrorCode.INTERNAL}), 500
 
 
 if __name__ == '__main__':
@@ -11,7 +11,8 @@ export interface LoginCredentials {
 export interface RegisterCredentials {
   username: string;
   password: string;
-  name: string;
+  name?: string;
+  email?: string;
 }
 
 export interface LoginResponse {
@@ -24,6 +25,27 @@ export interface UserInfo {
   name: string;
 }
 
+export interface ApiError {
+  error: string;
+  code: string;
+  errors?: { field: string; message: string }[];
+}
+
+// The auth service reports failures as JSON with a stable `code`; fall back
+// to the raw body for anything else (e.g. a proxy error page).
+async function readError(response: Response, fallback: string): Promise<Error> {
+  const text = await response.text();
+  try {
+    const data: ApiError = JSON.parse(text);
+    if (data.errors?.length) {
+      return new Error(data.errors.map((e) => `${e.field} ${e.message}`).join(', '));
+    }
+    return new Error(data.error || fallback);
+  } catch {
+    return new Error(text || fallback);
+  }
+}
+
 class AuthService {
   private getAuthHeaders(): HeadersInit {
     const token = localStorage.getItem('token');
@@ -43,8 +65,7 @@ class AuthService {
     });
 
     if (!response.ok) {
-      const errorText = await response.text();
-      throw new Error(errorText || 'Login failed');
+      throw await readError(response, 'Login failed');
     }
 
     const data: LoginResponse = await response.json();
@@ -63,8 +84,7 @@ class AuthService {
     });
 
     if (!response.ok) {
-      const errorText = await response.text();
-      throw new Error(errorText || 'Registration failed');
+      throw await readError(response, 'Registration failed');
     }
   }
 
@@ -75,8 +95,7 @@ class AuthService {
     });
 
     if (!response.ok) {
-      const errorText = await response.text();
-      throw new Error(errorText || 'Failed to fetch user info');
+      throw await readError(response, 'Failed to fetch user info');
     }
 
     return response.json();